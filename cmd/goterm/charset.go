@@ -0,0 +1,174 @@
+package main
+
+// Charset is a character set that can be designated into G0-G3.
+type Charset int
+
+const (
+	CHARSET_ASCII Charset = iota
+	CHARSET_DEC_GRAPHICS
+	CHARSET_DEC_SUPPLEMENTAL
+	CHARSET_DEC_TECHNICAL
+	CHARSET_LATIN1
+	CHARSET_UK
+	CHARSET_DUTCH
+	CHARSET_FINNISH
+	CHARSET_FRENCH
+	CHARSET_FRENCH_CANADIAN
+	CHARSET_GERMAN
+	CHARSET_ITALIAN
+	CHARSET_NORWEGIAN_DANISH
+	CHARSET_SPANISH
+	CHARSET_SWEDISH
+	CHARSET_SWISS
+)
+
+// charsets94 maps the final bytes (plus any second intermediate) of
+// ESC ( ) * + to the 94 character sets they designate.
+var charsets94 = map[string]Charset{
+	"B":  CHARSET_ASCII,
+	"0":  CHARSET_DEC_GRAPHICS,
+	"<":  CHARSET_DEC_SUPPLEMENTAL,
+	"%5": CHARSET_DEC_SUPPLEMENTAL,
+	">":  CHARSET_DEC_TECHNICAL,
+	"A":  CHARSET_UK,
+	"4":  CHARSET_DUTCH,
+	"C":  CHARSET_FINNISH,
+	"5":  CHARSET_FINNISH,
+	"R":  CHARSET_FRENCH,
+	"f":  CHARSET_FRENCH,
+	"Q":  CHARSET_FRENCH_CANADIAN,
+	"9":  CHARSET_FRENCH_CANADIAN,
+	"K":  CHARSET_GERMAN,
+	"Y":  CHARSET_ITALIAN,
+	"E":  CHARSET_NORWEGIAN_DANISH,
+	"6":  CHARSET_NORWEGIAN_DANISH,
+	"`":  CHARSET_NORWEGIAN_DANISH,
+	"Z":  CHARSET_SPANISH,
+	"H":  CHARSET_SWEDISH,
+	"7":  CHARSET_SWEDISH,
+	"=":  CHARSET_SWISS,
+}
+
+// charsets96 is the same for the 96 character sets of ESC - . /
+var charsets96 = map[string]Charset{
+	"A": CHARSET_LATIN1,
+}
+
+// charsetTables holds the code points each set replaces. Anything not
+// listed passes through as ASCII.
+var charsetTables = map[Charset]map[rune]rune{
+	CHARSET_DEC_GRAPHICS: {
+		'_': ' ', '`': '◆', 'a': '▒', 'b': '␉', 'c': '␌', 'd': '␍', 'e': '␊', 'f': '°',
+		'g': '±', 'h': '␤', 'i': '␋', 'j': '┘', 'k': '┐', 'l': '┌', 'm': '└', 'n': '┼',
+		'o': '⎺', 'p': '⎻', 'q': '─', 'r': '⎼', 's': '⎽', 't': '├', 'u': '┤', 'v': '┴',
+		'w': '┬', 'x': '│', 'y': '≤', 'z': '≥', '{': 'π', '|': '≠', '}': '£', '~': '·',
+	},
+	CHARSET_DEC_TECHNICAL: {
+		'!': '⎷', '"': '┌', '#': '─', '$': '⌠', '%': '⌡', '&': '│', '\'': '⎡', '(': '⎣',
+		')': '⎤', '*': '⎦', '+': '⎛', ',': '⎝', '-': '⎞', '.': '⎠', '/': '⎨', '0': '⎬',
+		'<': '≤', '=': '≠', '>': '≥', '?': '∫', '@': '∴', 'A': '∝', 'B': '∞', 'C': '÷',
+		'D': 'Δ', 'E': '∇', 'F': 'Φ', 'G': 'Γ', 'H': '∼', 'I': '≃', 'J': 'Θ', 'K': '×',
+		'L': 'Λ', 'M': '⇔', 'N': '⇒', 'O': '≡', 'P': 'Π', 'Q': 'Ψ', 'S': 'Σ', 'V': '√',
+		'W': 'Ω', 'X': 'Ξ', 'Y': 'Υ', 'Z': '⊂', '[': '⊃', '\\': '∩', ']': '∪', '^': '∧',
+		'_': '∨', '`': '¬', 'a': 'α', 'b': 'β', 'c': 'χ', 'd': 'δ', 'e': 'ε', 'f': 'φ',
+		'g': 'γ', 'h': 'η', 'i': 'ι', 'j': 'θ', 'k': 'κ', 'l': 'λ', 'n': 'ν', 'o': '∂',
+		'p': 'π', 'q': 'ψ', 'r': 'ρ', 's': 'σ', 't': 'τ', 'v': 'ƒ', 'w': 'ω', 'x': 'ξ',
+		'y': 'υ', 'z': 'ζ', '{': '←', '|': '↑', '}': '→', '~': '↓',
+	},
+	CHARSET_UK: {
+		'#': '£',
+	},
+	CHARSET_DUTCH: {
+		'#': '£', '@': '¾', '[': 'ĳ', '\\': '½', ']': '|', '{': '¨', '|': 'ƒ', '}': '¼', '~': '´',
+	},
+	CHARSET_FINNISH: {
+		'[': 'Ä', '\\': 'Ö', ']': 'Å', '^': 'Ü', '`': 'é', '{': 'ä', '|': 'ö', '}': 'å', '~': 'ü',
+	},
+	CHARSET_FRENCH: {
+		'#': '£', '@': 'à', '[': '°', '\\': 'ç', ']': '§', '{': 'é', '|': 'ù', '}': 'è', '~': '¨',
+	},
+	CHARSET_FRENCH_CANADIAN: {
+		'@': 'à', '[': 'â', '\\': 'ç', ']': 'ê', '^': 'î', '`': 'ô', '{': 'é', '|': 'ù', '}': 'è', '~': 'û',
+	},
+	CHARSET_GERMAN: {
+		'@': '§', '[': 'Ä', '\\': 'Ö', ']': 'Ü', '{': 'ä', '|': 'ö', '}': 'ü', '~': 'ß',
+	},
+	CHARSET_ITALIAN: {
+		'#': '£', '@': '§', '[': '°', '\\': 'ç', ']': 'é', '`': 'ù', '{': 'à', '|': 'ò', '}': 'è', '~': 'ì',
+	},
+	CHARSET_NORWEGIAN_DANISH: {
+		'@': 'Ä', '[': 'Æ', '\\': 'Ø', ']': 'Å', '^': 'Ü', '`': 'ä', '{': 'æ', '|': 'ø', '}': 'å', '~': 'ü',
+	},
+	CHARSET_SPANISH: {
+		'#': '£', '@': '§', '[': '¡', '\\': 'Ñ', ']': '¿', '{': '°', '|': 'ñ', '}': 'ç',
+	},
+	CHARSET_SWEDISH: {
+		'@': 'É', '[': 'Ä', '\\': 'Ö', ']': 'Å', '^': 'Ü', '`': 'é', '{': 'ä', '|': 'ö', '}': 'å', '~': 'ü',
+	},
+	CHARSET_SWISS: {
+		'#': 'ù', '@': 'à', '[': 'é', '\\': 'ç', ']': 'ê', '^': 'î', '_': 'è', '`': 'ô', '{': 'ä', '|': 'ö', '}': 'ü', '~': 'û',
+	},
+}
+
+// decSupplemental lists where the DEC multinational set differs from
+// the upper half of Latin-1.
+var decSupplemental = map[rune]rune{
+	0xa8: '¤', 0xd7: 'Œ', 0xdd: 'Ÿ', 0xf7: 'œ', 0xfd: 'ÿ',
+}
+
+// translate maps a printable ASCII character through the set.
+func (cs Charset) translate(c rune) rune {
+	if c < 0x20 || c > 0x7f {
+		return c
+	}
+	switch cs {
+	case CHARSET_ASCII:
+		return c
+	case CHARSET_LATIN1:
+		return c + 0x80
+	case CHARSET_DEC_SUPPLEMENTAL:
+		if c == 0x20 || c == 0x7f {
+			return c
+		}
+		if r, ok := decSupplemental[c+0x80]; ok {
+			return r
+		}
+		return c + 0x80
+	}
+	if r, ok := charsetTables[cs][c]; ok {
+		return r
+	}
+	return c
+}
+
+// designateCharset handles ESC ( ) * + - . / which load a set into
+// one of G0-G3.
+func (term *Terminal) designateCharset(token Token) {
+	name := string(token.Intermediates[1:]) + string(token.Final)
+
+	var cs Charset
+	var ok bool
+	g := 0
+	switch token.Intermediates[0] {
+	case '(', ')', '*', '+':
+		g = int(token.Intermediates[0] - '(')
+		cs, ok = charsets94[name]
+	case '-', '.', '/':
+		g = int(token.Intermediates[0]-'-') + 1
+		cs, ok = charsets96[name]
+	}
+	if ok {
+		term.charsets[g] = cs
+	}
+}
+
+// translateChar applies the set invoked into GL, or a pending single
+// shift, to a character about to be printed.
+func (term *Terminal) translateChar(c rune) rune {
+	g := term.charsetGL
+	if term.singleShift != 0 {
+		g = term.singleShift
+		term.singleShift = 0
+	}
+	return term.charsets[g].translate(c)
+}
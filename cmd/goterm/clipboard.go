@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/sheik/xgb/xproto"
+	"github.com/sheik/xgbutil"
+	"github.com/sheik/xgbutil/xevent"
+	"github.com/sheik/xgbutil/xprop"
+)
+
+// incrChunk is the most we put in a property at once. Anything bigger
+// is sent in pieces with the ICCCM INCR protocol.
+const incrChunk = 64 * 1024
+
+// Clipboard owns the PRIMARY and CLIPBOARD selections for the window
+// and hands their text to anyone who asks. It also fetches them from
+// other clients to paste.
+type Clipboard struct {
+	X      *xgbutil.XUtil
+	window xproto.Window
+
+	clipboard  xproto.Atom
+	utf8String xproto.Atom
+	text       xproto.Atom
+	targets    xproto.Atom
+	incr       xproto.Atom
+	// the property on our window that pastes arrive in
+	paste xproto.Atom
+
+	// the text of each selection we own
+	owned map[xproto.Atom]string
+
+	// INCR transfers in progress, by requestor and property
+	transfers map[incrKey]*incrTransfer
+
+	// called when another client takes a selection from us
+	lost func(selection xproto.Atom)
+
+	// a paste arriving with INCR, and its type
+	incoming     []byte
+	incomingType xproto.Atom
+	receiving    bool
+
+	// called with the text of a requested selection
+	pasted func(text string)
+}
+
+type incrKey struct {
+	requestor xproto.Window
+	property  xproto.Atom
+}
+
+type incrTransfer struct {
+	target xproto.Atom
+	data   []byte
+}
+
+func NewClipboard(X *xgbutil.XUtil, window xproto.Window) (*Clipboard, error) {
+	c := &Clipboard{
+		X:         X,
+		window:    window,
+		owned:     map[xproto.Atom]string{},
+		transfers: map[incrKey]*incrTransfer{},
+	}
+	var err error
+	for _, a := range []struct {
+		atom *xproto.Atom
+		name string
+	}{
+		{&c.clipboard, "CLIPBOARD"},
+		{&c.utf8String, "UTF8_STRING"},
+		{&c.text, "TEXT"},
+		{&c.targets, "TARGETS"},
+		{&c.incr, "INCR"},
+		{&c.paste, "GOTERM_SELECTION"},
+	} {
+		if *a.atom, err = xprop.Atm(X, a.name); err != nil {
+			return nil, err
+		}
+	}
+
+	xevent.SelectionRequestFun(c.selectionRequest).Connect(X, window)
+	xevent.SelectionClearFun(c.selectionClear).Connect(X, window)
+	xevent.SelectionNotifyFun(c.selectionNotify).Connect(X, window)
+	xevent.PropertyNotifyFun(c.propertyNotify).Connect(X, window)
+	return c, nil
+}
+
+// Own makes us the owner of a selection holding text.
+func (c *Clipboard) Own(selection xproto.Atom, text string, time xproto.Timestamp) {
+	xproto.SetSelectionOwner(c.X.Conn(), c.window, selection, time)
+	reply, err := xproto.GetSelectionOwner(c.X.Conn(), selection).Reply()
+	if err != nil || reply.Owner != c.window {
+		if *debug {
+			fmt.Println("unable to own selection", selection, err)
+		}
+		return
+	}
+	c.owned[selection] = text
+}
+
+// Request asks the owner of a selection for its text, which is passed
+// to pasted when it arrives. Our own selections go through the server
+// too, like anyone else's.
+func (c *Clipboard) Request(selection xproto.Atom, time xproto.Timestamp) {
+	xproto.ConvertSelection(c.X.Conn(), c.window, selection, c.utf8String, c.paste, time)
+}
+
+// selectionNotify receives a selection we asked for.
+func (c *Clipboard) selectionNotify(X *xgbutil.XUtil, e xevent.SelectionNotifyEvent) {
+	if e.Property == 0 {
+		// not every client has UTF8_STRING
+		if e.Target == c.utf8String {
+			xproto.ConvertSelection(X.Conn(), c.window, e.Selection, xproto.AtomString, c.paste, e.Time)
+		}
+		return
+	}
+
+	typ, data, err := c.takeProperty(e.Property)
+	if err != nil {
+		if *debug {
+			fmt.Println("unable to read selection", err)
+		}
+		return
+	}
+	if typ == c.incr {
+		// deleting the property has asked for the first chunk
+		c.incoming, c.receiving = nil, true
+		return
+	}
+	c.deliver(typ, data)
+}
+
+// takeProperty reads and deletes a property on our window.
+func (c *Clipboard) takeProperty(property xproto.Atom) (xproto.Atom, []byte, error) {
+	reply, err := xproto.GetProperty(c.X.Conn(), true, c.window, property,
+		xproto.GetPropertyTypeAny, 0, math.MaxUint32/4).Reply()
+	if err != nil {
+		return 0, nil, err
+	}
+	return reply.Type, reply.Value, nil
+}
+
+func (c *Clipboard) deliver(typ xproto.Atom, data []byte) {
+	text := string(data)
+	if typ == xproto.AtomString {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	if c.pasted != nil {
+		c.pasted(text)
+	}
+}
+
+func (c *Clipboard) selectionClear(X *xgbutil.XUtil, e xevent.SelectionClearEvent) {
+	delete(c.owned, e.Selection)
+	if c.lost != nil {
+		c.lost(e.Selection)
+	}
+}
+
+// selectionRequest answers another client asking for a selection we
+// own, with the text or the list of targets we can convert it to.
+func (c *Clipboard) selectionRequest(X *xgbutil.XUtil, e xevent.SelectionRequestEvent) {
+	property := e.Property
+	if property == 0 {
+		// obsolete clients leave the property to us
+		property = e.Target
+	}
+
+	text, ok := c.owned[e.Selection]
+	if !ok {
+		c.notify(e.SelectionRequestEvent, 0)
+		return
+	}
+
+	switch e.Target {
+	case c.targets:
+		targets := []xproto.Atom{c.targets, c.utf8String, c.text, xproto.AtomString}
+		data := make([]byte, 4*len(targets))
+		for i, t := range targets {
+			binary.LittleEndian.PutUint32(data[4*i:], uint32(t))
+		}
+		xproto.ChangeProperty(X.Conn(), xproto.PropModeReplace, e.Requestor, property,
+			xproto.AtomAtom, 32, uint32(len(targets)), data)
+	case c.utf8String, c.text:
+		c.sendData(e.Requestor, property, c.utf8String, []byte(text))
+	case xproto.AtomString:
+		c.sendData(e.Requestor, property, xproto.AtomString, latin1(text))
+	default:
+		property = 0
+	}
+	c.notify(e.SelectionRequestEvent, property)
+}
+
+// sendData puts data in the requestor's property, or starts an INCR
+// transfer if it is too big.
+func (c *Clipboard) sendData(requestor xproto.Window, property, target xproto.Atom, data []byte) {
+	if len(data) <= incrChunk {
+		xproto.ChangeProperty(c.X.Conn(), xproto.PropModeReplace, requestor, property,
+			target, 8, uint32(len(data)), data)
+		return
+	}
+
+	key := incrKey{requestor, property}
+	if len(c.transfersTo(requestor)) == 0 && requestor != c.window {
+		// the requestor deleting the property asks for the next chunk
+		xproto.ChangeWindowAttributes(c.X.Conn(), requestor, xproto.CwEventMask,
+			[]uint32{xproto.EventMaskPropertyChange})
+		xevent.PropertyNotifyFun(c.propertyNotify).Connect(c.X, requestor)
+	}
+	c.transfers[key] = &incrTransfer{target: target, data: data}
+
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(data)))
+	xproto.ChangeProperty(c.X.Conn(), xproto.PropModeReplace, requestor, property,
+		c.incr, 32, 1, size)
+}
+
+func (c *Clipboard) propertyNotify(X *xgbutil.XUtil, e xevent.PropertyNotifyEvent) {
+	if c.receiving && e.Window == c.window && e.Atom == c.paste && e.State == xproto.PropertyNewValue {
+		c.receiveChunk()
+		return
+	}
+
+	key := incrKey{e.Window, e.Atom}
+	t, ok := c.transfers[key]
+	if !ok || e.State != xproto.PropertyDelete {
+		return
+	}
+
+	chunk := t.data
+	if len(chunk) > incrChunk {
+		chunk = chunk[:incrChunk]
+	}
+	t.data = t.data[len(chunk):]
+	// an empty chunk ends the transfer
+	xproto.ChangeProperty(X.Conn(), xproto.PropModeReplace, e.Window, e.Atom,
+		t.target, 8, uint32(len(chunk)), chunk)
+
+	if len(chunk) == 0 {
+		delete(c.transfers, key)
+		if len(c.transfersTo(e.Window)) == 0 && e.Window != c.window {
+			xproto.ChangeWindowAttributes(X.Conn(), e.Window, xproto.CwEventMask, []uint32{0})
+			xevent.Detach(X, e.Window)
+		}
+	}
+}
+
+// receiveChunk takes the next piece of an INCR paste. An empty one
+// means it is finished.
+func (c *Clipboard) receiveChunk() {
+	typ, data, err := c.takeProperty(c.paste)
+	if err != nil {
+		c.receiving = false
+		return
+	}
+	if len(data) > 0 {
+		c.incoming = append(c.incoming, data...)
+		c.incomingType = typ
+		return
+	}
+	c.receiving = false
+	c.deliver(c.incomingType, c.incoming)
+	c.incoming = nil
+}
+
+func (c *Clipboard) transfersTo(requestor xproto.Window) []*incrTransfer {
+	var transfers []*incrTransfer
+	for key, t := range c.transfers {
+		if key.requestor == requestor {
+			transfers = append(transfers, t)
+		}
+	}
+	return transfers
+}
+
+// notify tells the requestor its request is done. A property of None
+// means it was refused.
+func (c *Clipboard) notify(req *xproto.SelectionRequestEvent, property xproto.Atom) {
+	ev := xproto.SelectionNotifyEvent{
+		Time:      req.Time,
+		Requestor: req.Requestor,
+		Selection: req.Selection,
+		Target:    req.Target,
+		Property:  property,
+	}
+	xproto.SendEvent(c.X.Conn(), false, req.Requestor, xproto.EventMaskNoEvent, string(ev.Bytes()))
+}
+
+// latin1 converts text for the STRING target, which can only hold
+// Latin-1.
+func latin1(text string) []byte {
+	b := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r > 0xff {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
@@ -0,0 +1,84 @@
+//go:build ignore
+
+// gen_keysyms writes keysym_table.go from X11's keysymdef.h. Run it
+// with go generate.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var (
+	input  = flag.String("i", "/usr/include/X11/keysymdef.h", "keysymdef.h to read")
+	output = flag.String("o", "keysym_table.go", "file to write")
+)
+
+// only exact mappings; the ones in parentheses are approximate
+var define = regexp.MustCompile(`^#define XK_\w+\s+0x([0-9a-fA-F]+)\s*/\* U\+([0-9A-Fa-f]+) `)
+
+func main() {
+	flag.Parse()
+
+	f, err := os.Open(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	table := map[uint64]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := define.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		sym, _ := strconv.ParseUint(m[1], 16, 32)
+		r, _ := strconv.ParseUint(m[2], 16, 32)
+		// Latin-1 and Unicode keysyms are worked out directly, and
+		// function and keypad keys are left to encodeKey
+		if sym >= 0x20 && sym <= 0xff || sym >= 0x01000000 || sym >= 0xfd00 {
+			continue
+		}
+		if _, ok := table[sym]; !ok {
+			table[sym] = r
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	syms := make([]uint64, 0, len(table))
+	for sym := range table {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i] < syms[j] })
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "// Code generated by gen_keysyms.go from keysymdef.h; DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "package main")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "// keysymTable maps the legacy keysyms outside Latin-1 to Unicode.")
+	fmt.Fprintln(&b, "var keysymTable = map[uint32]rune{")
+	for _, sym := range syms {
+		fmt.Fprintf(&b, "0x%04x: 0x%04x,\n", sym, table[sym])
+	}
+	fmt.Fprintln(&b, "}")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
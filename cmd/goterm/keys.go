@@ -0,0 +1,254 @@
+package main
+
+import "fmt"
+
+// X keysyms for the keys that don't just send a character
+const (
+	KEY_ISO_LEFT_TAB = 0xfe20
+	KEY_BACKSPACE    = 0xff08
+	KEY_TAB          = 0xff09
+	KEY_RETURN       = 0xff0d
+	KEY_ESCAPE       = 0xff1b
+	KEY_HOME         = 0xff50
+	KEY_LEFT         = 0xff51
+	KEY_UP           = 0xff52
+	KEY_RIGHT        = 0xff53
+	KEY_DOWN         = 0xff54
+	KEY_PRIOR        = 0xff55
+	KEY_NEXT         = 0xff56
+	KEY_END          = 0xff57
+	KEY_BEGIN        = 0xff58
+	KEY_INSERT       = 0xff63
+	KEY_DELETE       = 0xffff
+
+	KEY_KP_SPACE     = 0xff80
+	KEY_KP_TAB       = 0xff89
+	KEY_KP_ENTER     = 0xff8d
+	KEY_KP_F1        = 0xff91
+	KEY_KP_F4        = 0xff94
+	KEY_KP_HOME      = 0xff95
+	KEY_KP_LEFT      = 0xff96
+	KEY_KP_UP        = 0xff97
+	KEY_KP_RIGHT     = 0xff98
+	KEY_KP_DOWN      = 0xff99
+	KEY_KP_PRIOR     = 0xff9a
+	KEY_KP_NEXT      = 0xff9b
+	KEY_KP_END       = 0xff9c
+	KEY_KP_BEGIN     = 0xff9d
+	KEY_KP_INSERT    = 0xff9e
+	KEY_KP_DELETE    = 0xff9f
+	KEY_KP_MULTIPLY  = 0xffaa
+	KEY_KP_ADD       = 0xffab
+	KEY_KP_SEPARATOR = 0xffac
+	KEY_KP_SUBTRACT  = 0xffad
+	KEY_KP_DECIMAL   = 0xffae
+	KEY_KP_DIVIDE    = 0xffaf
+	KEY_KP_0         = 0xffb0
+	KEY_KP_9         = 0xffb9
+	KEY_KP_EQUAL     = 0xffbd
+
+	KEY_F1  = 0xffbe
+	KEY_F4  = 0xffc1
+	KEY_F20 = 0xffd1
+)
+
+// KeyMods are the modifiers held down with a key, with the values
+// xterm adds to 1 to make the modifier parameter.
+type KeyMods uint8
+
+const (
+	MOD_SHIFT KeyMods = 1 << iota
+	MOD_ALT
+	MOD_CTRL
+)
+
+// KeyModes are the terminal modes that change what a key sends.
+type KeyModes struct {
+	// DECCKM: cursor keys send SS3 rather than CSI
+	appCursor bool
+	// DECKPAM: the keypad sends SS3 sequences rather than what is
+	// printed on it
+	appKeypad bool
+	// xterm's modifyOtherKeys level, from CSI > 4 ; n m
+	modifyOtherKeys int
+}
+
+func (term *Terminal) keyModes() KeyModes {
+	return KeyModes{
+		appCursor:       term.appCursorKeys,
+		appKeypad:       term.appKeypad,
+		modifyOtherKeys: term.modifyOtherKeys,
+	}
+}
+
+// setKeyModifierOptions handles XTMODKEYS (CSI > Pp ; Pv m) and its
+// reset (CSI > Pp n). Only modifyOtherKeys is supported.
+func (term *Terminal) setKeyModifierOptions(token Token) {
+	if len(token.Params) == 0 || token.Params[0] != 4 {
+		return
+	}
+	term.modifyOtherKeys = 0
+	if token.Final == 'm' {
+		term.modifyOtherKeys = token.Param(1, 0)
+	}
+}
+
+// cursorFinals are the final bytes sent for the cursor keys, which
+// the keypad's own cursor keys share.
+var cursorFinals = map[uint32]byte{
+	KEY_UP: 'A', KEY_DOWN: 'B', KEY_RIGHT: 'C', KEY_LEFT: 'D',
+	KEY_HOME: 'H', KEY_END: 'F', KEY_BEGIN: 'E',
+	KEY_KP_UP: 'A', KEY_KP_DOWN: 'B', KEY_KP_RIGHT: 'C', KEY_KP_LEFT: 'D',
+	KEY_KP_HOME: 'H', KEY_KP_END: 'F', KEY_KP_BEGIN: 'E',
+}
+
+// tildeKeys send CSI n ~.
+var tildeKeys = map[uint32]int{
+	KEY_INSERT: 2, KEY_DELETE: 3, KEY_PRIOR: 5, KEY_NEXT: 6,
+	KEY_KP_INSERT: 2, KEY_KP_DELETE: 3, KEY_KP_PRIOR: 5, KEY_KP_NEXT: 6,
+}
+
+// functionKeys are the CSI n ~ numbers for F5 to F20. F1-F4 are like
+// the cursor keys.
+var functionKeys = []int{15, 17, 18, 19, 20, 21, 23, 24, 25, 26, 28, 29, 31, 32, 33, 34}
+
+// keypadChars are what the keypad sends in numeric mode. In
+// application mode it sends SS3 and the final byte at the same
+// offset from 'p' as the key is from KP_0, as xterm does.
+var keypadChars = map[uint32]rune{
+	KEY_KP_SPACE: ' ', KEY_KP_TAB: '\t', KEY_KP_ENTER: '\r',
+	KEY_KP_MULTIPLY: '*', KEY_KP_ADD: '+', KEY_KP_SEPARATOR: ',',
+	KEY_KP_SUBTRACT: '-', KEY_KP_DECIMAL: '.', KEY_KP_DIVIDE: '/',
+	KEY_KP_EQUAL: '=',
+}
+
+// encodeKey returns the bytes xterm would send for a keysym with mods
+// held down, or nil for keys that send nothing, like the modifiers
+// themselves. Any shift level has already been applied to sym.
+func encodeKey(sym uint32, mods KeyMods, modes KeyModes) []byte {
+	// the modifier parameter, or 1 for none
+	m := 1 + int(mods)
+
+	if final, ok := cursorFinals[sym]; ok {
+		switch {
+		case mods != 0:
+			return []byte(fmt.Sprintf("\033[1;%d%c", m, final))
+		case modes.appCursor:
+			return []byte{0x1b, 'O', final}
+		}
+		return []byte{0x1b, '[', final}
+	}
+	if sym >= KEY_KP_F1 && sym <= KEY_KP_F4 || sym >= KEY_F1 && sym <= KEY_F4 {
+		final := byte('P' + sym - KEY_F1)
+		if sym <= KEY_KP_F4 {
+			// PF1-PF4
+			final = byte('P' + sym - KEY_KP_F1)
+		}
+		if mods != 0 {
+			return []byte(fmt.Sprintf("\033[1;%d%c", m, final))
+		}
+		return []byte{0x1b, 'O', final}
+	}
+	if n, ok := tildeKeys[sym]; ok {
+		return tildeKey(n, m)
+	}
+	if sym > KEY_F4 && sym <= KEY_F20 {
+		return tildeKey(functionKeys[sym-KEY_F4-1], m)
+	}
+
+	if c, ok := keypadChars[sym]; ok || sym >= KEY_KP_0 && sym <= KEY_KP_9 {
+		if !ok {
+			c = rune('0' + sym - KEY_KP_0)
+		}
+		if modes.appKeypad {
+			switch sym {
+			case KEY_KP_SPACE:
+				return []byte{0x1b, 'O', ' '}
+			case KEY_KP_EQUAL:
+				return []byte{0x1b, 'O', 'X'}
+			}
+			return []byte{0x1b, 'O', byte(int('p') + int(sym) - KEY_KP_0)}
+		}
+		return encodeChar(c, mods, modes)
+	}
+
+	switch sym {
+	case KEY_BACKSPACE:
+		b := byte(0x7f)
+		if mods&MOD_CTRL != 0 {
+			b = 0x08
+		}
+		return altPrefix([]byte{b}, mods)
+	case KEY_TAB, KEY_ISO_LEFT_TAB:
+		if mods&MOD_SHIFT != 0 || sym == KEY_ISO_LEFT_TAB {
+			return altPrefix([]byte("\033[Z"), mods)
+		}
+		return altPrefix([]byte{'\t'}, mods)
+	case KEY_RETURN:
+		return altPrefix([]byte{'\r'}, mods)
+	case KEY_ESCAPE:
+		return altPrefix([]byte{0x1b}, mods)
+	}
+
+	if c, ok := keysymRune(sym); ok {
+		return encodeChar(c, mods, modes)
+	}
+	return nil
+}
+
+func tildeKey(n, m int) []byte {
+	if m > 1 {
+		return []byte(fmt.Sprintf("\033[%d;%d~", n, m))
+	}
+	return []byte(fmt.Sprintf("\033[%d~", n))
+}
+
+// encodeChar handles keys that type a character. Control turns it
+// into a C0 control where there is one, Alt puts ESC in front, and
+// with modifyOtherKeys the combinations are sent as CSI 27 ; m ; c ~
+// instead.
+func encodeChar(c rune, mods KeyMods, modes KeyModes) []byte {
+	// Shift has already picked the character
+	if mods&^MOD_SHIFT == 0 {
+		mods = 0
+	}
+	ctrl, isControl := controlChar(c)
+
+	switch {
+	case mods == 0:
+	case modes.modifyOtherKeys >= 2,
+		modes.modifyOtherKeys == 1 && mods&MOD_CTRL != 0 && !isControl:
+		return []byte(fmt.Sprintf("\033[27;%d;%d~", 1+int(mods), c))
+	}
+
+	b := []byte(string(c))
+	if mods&MOD_CTRL != 0 && isControl {
+		b = []byte{ctrl}
+	}
+	return altPrefix(b, mods)
+}
+
+// controlChar is what Ctrl turns c into, following xterm and the
+// VT220: letters and @[\]^_ map onto C0, as do 2-8 and / ? ` and space.
+func controlChar(c rune) (byte, bool) {
+	switch {
+	case c >= '@' && c <= '_', c >= 'a' && c <= 'z':
+		return byte(c & 0x1f), true
+	case c == ' ', c == '2', c == '`':
+		return 0, true
+	case c >= '3' && c <= '7':
+		return byte(c - '3' + 0x1b), true
+	case c == '8', c == '?':
+		return 0x7f, true
+	case c == '/':
+		return 0x1f, true
+	}
+	return 0, false
+}
+
+func altPrefix(b []byte, mods KeyMods) []byte {
+	if mods&MOD_ALT != 0 {
+		return append([]byte{0x1b}, b...)
+	}
+	return b
+}
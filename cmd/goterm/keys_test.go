@@ -0,0 +1,145 @@
+package main
+
+import "testing"
+
+func TestEncodeKey(t *testing.T) {
+	cursor := KeyModes{appCursor: true}
+	keypad := KeyModes{appKeypad: true}
+	other1 := KeyModes{modifyOtherKeys: 1}
+	other2 := KeyModes{modifyOtherKeys: 2}
+
+	tests := []struct {
+		name  string
+		sym   uint32
+		mods  KeyMods
+		modes KeyModes
+		want  string
+	}{
+		// cursor keys, with and without DECCKM
+		{"up", KEY_UP, 0, KeyModes{}, "\033[A"},
+		{"down", KEY_DOWN, 0, KeyModes{}, "\033[B"},
+		{"right", KEY_RIGHT, 0, KeyModes{}, "\033[C"},
+		{"left", KEY_LEFT, 0, KeyModes{}, "\033[D"},
+		{"home", KEY_HOME, 0, KeyModes{}, "\033[H"},
+		{"end", KEY_END, 0, KeyModes{}, "\033[F"},
+		{"up DECCKM", KEY_UP, 0, cursor, "\033OA"},
+		{"left DECCKM", KEY_LEFT, 0, cursor, "\033OD"},
+		{"home DECCKM", KEY_HOME, 0, cursor, "\033OH"},
+		{"keypad up", KEY_KP_UP, 0, KeyModes{}, "\033[A"},
+		{"ctrl right", KEY_RIGHT, MOD_CTRL, KeyModes{}, "\033[1;5C"},
+		{"ctrl right DECCKM", KEY_RIGHT, MOD_CTRL, cursor, "\033[1;5C"},
+		{"shift up", KEY_UP, MOD_SHIFT, KeyModes{}, "\033[1;2A"},
+		{"ctrl alt shift left", KEY_LEFT, MOD_CTRL | MOD_ALT | MOD_SHIFT, KeyModes{}, "\033[1;8D"},
+
+		// editing keys
+		{"insert", KEY_INSERT, 0, KeyModes{}, "\033[2~"},
+		{"delete", KEY_DELETE, 0, KeyModes{}, "\033[3~"},
+		{"page up", KEY_PRIOR, 0, KeyModes{}, "\033[5~"},
+		{"ctrl page down", KEY_NEXT, MOD_CTRL, KeyModes{}, "\033[6;5~"},
+
+		// function keys with modifiers
+		{"shift F1", KEY_F1, MOD_SHIFT, KeyModes{}, "\033[1;2P"},
+		{"ctrl F4", KEY_F4, MOD_CTRL, KeyModes{}, "\033[1;5S"},
+		{"ctrl F5", KEY_F1 + 4, MOD_CTRL, KeyModes{}, "\033[15;5~"},
+		{"alt F12", KEY_F1 + 11, MOD_ALT, KeyModes{}, "\033[24;3~"},
+		{"PF1", KEY_KP_F1, 0, KeyModes{}, "\033OP"},
+		{"PF4", KEY_KP_F4, 0, KeyModes{}, "\033OS"},
+
+		// the keypad in numeric and application mode
+		{"KP_5", KEY_KP_0 + 5, 0, KeyModes{}, "5"},
+		{"KP_Enter", KEY_KP_ENTER, 0, KeyModes{}, "\r"},
+		{"KP_Add", KEY_KP_ADD, 0, KeyModes{}, "+"},
+		{"KP_0 DECKPAM", KEY_KP_0, 0, keypad, "\033Op"},
+		{"KP_9 DECKPAM", KEY_KP_9, 0, keypad, "\033Oy"},
+		{"KP_Enter DECKPAM", KEY_KP_ENTER, 0, keypad, "\033OM"},
+		{"KP_Multiply DECKPAM", KEY_KP_MULTIPLY, 0, keypad, "\033Oj"},
+		{"KP_Add DECKPAM", KEY_KP_ADD, 0, keypad, "\033Ok"},
+		{"KP_Separator DECKPAM", KEY_KP_SEPARATOR, 0, keypad, "\033Ol"},
+		{"KP_Subtract DECKPAM", KEY_KP_SUBTRACT, 0, keypad, "\033Om"},
+		{"KP_Decimal DECKPAM", KEY_KP_DECIMAL, 0, keypad, "\033On"},
+		{"KP_Divide DECKPAM", KEY_KP_DIVIDE, 0, keypad, "\033Oo"},
+		{"KP_Equal DECKPAM", KEY_KP_EQUAL, 0, keypad, "\033OX"},
+		{"KP_Space DECKPAM", KEY_KP_SPACE, 0, keypad, "\033O "},
+		{"KP_Up DECKPAM", KEY_KP_UP, 0, keypad, "\033[A"},
+
+		// Ctrl makes C0 controls
+		{"ctrl a", 'a', MOD_CTRL, KeyModes{}, "\x01"},
+		{"ctrl z", 'z', MOD_CTRL, KeyModes{}, "\x1a"},
+		{"ctrl @", '@', MOD_CTRL, KeyModes{}, "\x00"},
+		{"ctrl [", '[', MOD_CTRL, KeyModes{}, "\x1b"},
+		{"ctrl \\", '\\', MOD_CTRL, KeyModes{}, "\x1c"},
+		{"ctrl ]", ']', MOD_CTRL, KeyModes{}, "\x1d"},
+		{"ctrl ^", '^', MOD_CTRL, KeyModes{}, "\x1e"},
+		{"ctrl _", '_', MOD_CTRL, KeyModes{}, "\x1f"},
+		{"ctrl space", ' ', MOD_CTRL, KeyModes{}, "\x00"},
+		{"ctrl 2", '2', MOD_CTRL, KeyModes{}, "\x00"},
+		{"ctrl 3", '3', MOD_CTRL, KeyModes{}, "\x1b"},
+		{"ctrl 7", '7', MOD_CTRL, KeyModes{}, "\x1f"},
+		{"ctrl 8", '8', MOD_CTRL, KeyModes{}, "\x7f"},
+		{"ctrl /", '/', MOD_CTRL, KeyModes{}, "\x1f"},
+		{"ctrl ?", '?', MOD_CTRL, KeyModes{}, "\x7f"},
+		{"ctrl 1", '1', MOD_CTRL, KeyModes{}, "1"},
+		{"ctrl backspace", KEY_BACKSPACE, MOD_CTRL, KeyModes{}, "\x08"},
+
+		// Alt puts ESC in front
+		{"alt a", 'a', MOD_ALT, KeyModes{}, "\033a"},
+		{"alt shift A", 'A', MOD_ALT | MOD_SHIFT, KeyModes{}, "\033A"},
+		{"ctrl alt a", 'a', MOD_CTRL | MOD_ALT, KeyModes{}, "\033\x01"},
+		{"alt backspace", KEY_BACKSPACE, MOD_ALT, KeyModes{}, "\033\x7f"},
+		{"alt return", KEY_RETURN, MOD_ALT, KeyModes{}, "\033\r"},
+		{"alt é", 0xe9, MOD_ALT, KeyModes{}, "\033é"},
+
+		// plain keys
+		{"a", 'a', 0, KeyModes{}, "a"},
+		{"shift A", 'A', MOD_SHIFT, KeyModes{}, "A"},
+		{"backspace", KEY_BACKSPACE, 0, KeyModes{}, "\x7f"},
+		{"tab", KEY_TAB, 0, KeyModes{}, "\t"},
+		{"shift tab", KEY_TAB, MOD_SHIFT, KeyModes{}, "\033[Z"},
+		{"ISO_Left_Tab", KEY_ISO_LEFT_TAB, MOD_SHIFT, KeyModes{}, "\033[Z"},
+		{"return", KEY_RETURN, 0, KeyModes{}, "\r"},
+		{"escape", KEY_ESCAPE, 0, KeyModes{}, "\033"},
+		{"euro", 0x20ac, 0, KeyModes{}, "€"},
+
+		// modifyOtherKeys 1 only changes combinations with no C0 control
+		{"ctrl a mok1", 'a', MOD_CTRL, other1, "\x01"},
+		{"ctrl 1 mok1", '1', MOD_CTRL, other1, "\033[27;5;49~"},
+		{"ctrl . mok1", '.', MOD_CTRL, other1, "\033[27;5;46~"},
+		{"alt a mok1", 'a', MOD_ALT, other1, "\033a"},
+		{"a mok1", 'a', 0, other1, "a"},
+
+		// modifyOtherKeys 2 changes all of them
+		{"ctrl a mok2", 'a', MOD_CTRL, other2, "\033[27;5;97~"},
+		{"alt a mok2", 'a', MOD_ALT, other2, "\033[27;3;97~"},
+		{"ctrl shift A mok2", 'A', MOD_CTRL | MOD_SHIFT, other2, "\033[27;6;65~"},
+		{"shift A mok2", 'A', MOD_SHIFT, other2, "A"},
+		{"a mok2", 'a', 0, other2, "a"},
+		{"ctrl up mok2", KEY_UP, MOD_CTRL, other2, "\033[1;5A"},
+
+		// modifiers on their own send nothing
+		{"shift", 0xffe1, MOD_SHIFT, KeyModes{}, ""},
+		{"control", 0xffe3, MOD_CTRL, KeyModes{}, ""},
+	}
+	for _, tt := range tests {
+		if got := string(encodeKey(tt.sym, tt.mods, tt.modes)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeFunctionKeys(t *testing.T) {
+	want := []string{
+		"\033OP", "\033OQ", "\033OR", "\033OS",
+		"\033[15~", "\033[17~", "\033[18~", "\033[19~",
+		"\033[20~", "\033[21~", "\033[23~", "\033[24~",
+		"\033[25~", "\033[26~", "\033[28~", "\033[29~",
+		"\033[31~", "\033[32~", "\033[33~", "\033[34~",
+	}
+	for i, w := range want {
+		if got := string(encodeKey(KEY_F1+uint32(i), 0, KeyModes{})); got != w {
+			t.Errorf("F%d: got %q, want %q", i+1, got, w)
+		}
+	}
+	if got := string(encodeKey(KEY_F20, 0, KeyModes{})); got != want[19] {
+		t.Errorf("KEY_F20: got %q, want %q", got, want[19])
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:generate go run gen_keysyms.go
+
+// keysyms bound to the modifiers that matter for choosing a keysym
+const (
+	KEY_ISO_LEVEL3_SHIFT = 0xfe03
+	KEY_MODE_SWITCH      = 0xff7e
+	KEY_NUM_LOCK         = 0xff7f
+	KEY_SHIFT_LOCK       = 0xffe6
+	KEY_ALT_L            = 0xffe9
+	KEY_ALT_R            = 0xffea
+)
+
+// Unicode keysyms are this plus the code point
+const keysymUnicodeOffset = 0x01000000
+
+// KeyState is the part of the modifier state that decides which of a
+// key's keysyms it produces.
+type KeyState struct {
+	shift      bool
+	lock       bool
+	shiftLock  bool
+	numLock    bool
+	modeSwitch bool
+	level3     bool
+}
+
+// chooseKeysym picks the keysym for a key from its list in the core
+// keyboard mapping, following the rules in the X protocol: Mode_switch
+// selects the second group, and within a group Num Lock, Shift and
+// Lock pick the level. Servers with XKB put the third and fourth
+// levels of the first group, reached with ISO_Level3_Shift (AltGr),
+// in the fifth and sixth columns.
+func chooseKeysym(syms []uint32, st KeyState) uint32 {
+	col := func(i int) uint32 {
+		if i < len(syms) {
+			return syms[i]
+		}
+		return 0
+	}
+
+	k1, k2 := col(0), col(1)
+	switch {
+	case st.level3 && (col(4) != 0 || col(5) != 0):
+		k1, k2 = col(4), col(5)
+	case st.modeSwitch && (col(2) != 0 || col(3) != 0):
+		k1, k2 = col(2), col(3)
+	}
+
+	if k2 == 0 {
+		if upper := keysymUpper(k1); upper != k1 {
+			k2 = upper
+		} else {
+			k2 = k1
+		}
+	}
+
+	switch {
+	case st.numLock && isKeypadKeysym(k2):
+		if st.shift || st.lock && st.shiftLock {
+			return k1
+		}
+		return k2
+	case !st.shift && !st.lock:
+		return k1
+	case !st.shift && st.lock && !st.shiftLock:
+		return keysymUpper(k1)
+	case st.shift && st.lock && !st.shiftLock:
+		return keysymUpper(k2)
+	}
+	return k2
+}
+
+func isKeypadKeysym(sym uint32) bool {
+	return sym >= KEY_KP_SPACE && sym <= KEY_KP_EQUAL
+}
+
+// keysymUpper is the upper case version of a keysym that types a
+// letter.
+func keysymUpper(sym uint32) uint32 {
+	r, ok := keysymRune(sym)
+	if !ok {
+		return sym
+	}
+	upper := unicode.ToUpper(r)
+	if upper == r {
+		return sym
+	}
+	return runeKeysym(upper)
+}
+
+// runeKeysym is the keysym that types r.
+func runeKeysym(r rune) uint32 {
+	if r >= 0x20 && r <= 0x7e || r >= 0xa0 && r <= 0xff {
+		return uint32(r)
+	}
+	return keysymUnicodeOffset + uint32(r)
+}
+
+// keysymRune returns the character a keysym types. Latin-1 keysyms
+// are their own code points, Unicode keysyms are 0x01000000 plus the
+// code point, and the older legacy keysyms are looked up in
+// keysymTable.
+func keysymRune(sym uint32) (rune, bool) {
+	switch {
+	case sym >= 0x20 && sym <= 0x7e, sym >= 0xa0 && sym <= 0xff:
+		return rune(sym), true
+	case sym >= keysymUnicodeOffset+0x100 && sym <= keysymUnicodeOffset+0x10ffff:
+		r := rune(sym - keysymUnicodeOffset)
+		return r, utf8.ValidRune(r)
+	}
+	r, ok := keysymTable[sym]
+	return r, ok
+}
@@ -0,0 +1,107 @@
+package main
+
+import "testing"
+
+func TestChooseKeysym(t *testing.T) {
+	letter := []uint32{'a', 'A'}
+	single := []uint32{'a'}
+	digit := []uint32{'1', '!'}
+	cyrillic := []uint32{0x06c1, 0x06e1}
+	keypad := []uint32{KEY_KP_HOME, KEY_KP_0 + 7}
+	greek := []uint32{'a', 'A', keysymUnicodeOffset + 0x3b1, keysymUnicodeOffset + 0x391}
+	altgr := []uint32{'e', 'E', 0, 0, 0x20ac, 0xa2}
+	altgrOne := []uint32{'o', 'O', 0, 0, 0xf8}
+
+	capsLock := KeyState{lock: true}
+	shiftLock := KeyState{lock: true, shiftLock: true}
+
+	tests := []struct {
+		name string
+		syms []uint32
+		st   KeyState
+		want uint32
+	}{
+		{"letter", letter, KeyState{}, 'a'},
+		{"letter shift", letter, KeyState{shift: true}, 'A'},
+		{"letter caps lock", letter, capsLock, 'A'},
+		{"letter shift caps lock", letter, KeyState{shift: true, lock: true}, 'A'},
+		{"letter shift lock", letter, shiftLock, 'A'},
+		{"letter shift and shift lock", letter, KeyState{shift: true, lock: true, shiftLock: true}, 'A'},
+
+		// a lone keysym gets its upper case as the second
+		{"single", single, KeyState{}, 'a'},
+		{"single shift", single, KeyState{shift: true}, 'A'},
+
+		// Caps Lock only changes letters, Shift Lock acts as Shift
+		{"digit caps lock", digit, capsLock, '1'},
+		{"digit shift caps lock", digit, KeyState{shift: true, lock: true}, '!'},
+		{"digit shift lock", digit, shiftLock, '!'},
+
+		// legacy keysyms are upper cased through Unicode
+		{"cyrillic shift", cyrillic, KeyState{shift: true}, 0x06e1},
+		{"cyrillic caps lock", cyrillic, capsLock, keysymUnicodeOffset + 0x410},
+
+		// Num Lock swaps the keypad's levels, and Shift swaps them back
+		{"keypad", keypad, KeyState{}, KEY_KP_HOME},
+		{"keypad num lock", keypad, KeyState{numLock: true}, KEY_KP_0 + 7},
+		{"keypad num lock shift", keypad, KeyState{numLock: true, shift: true}, KEY_KP_HOME},
+		{"keypad num lock shift lock", keypad, KeyState{numLock: true, lock: true, shiftLock: true}, KEY_KP_HOME},
+		{"keypad num lock caps lock", keypad, KeyState{numLock: true, lock: true}, KEY_KP_0 + 7},
+		{"num lock on a letter", letter, KeyState{numLock: true}, 'a'},
+
+		// Mode_switch picks the second group if there is one
+		{"mode switch", greek, KeyState{modeSwitch: true}, keysymUnicodeOffset + 0x3b1},
+		{"mode switch shift", greek, KeyState{modeSwitch: true, shift: true}, keysymUnicodeOffset + 0x391},
+		{"mode switch no group", letter, KeyState{modeSwitch: true}, 'a'},
+
+		// ISO_Level3_Shift picks the fifth and sixth columns
+		{"level3", altgr, KeyState{level3: true}, 0x20ac},
+		{"level3 shift", altgr, KeyState{level3: true, shift: true}, 0xa2},
+		{"level3 no columns", letter, KeyState{level3: true}, 'a'},
+		{"level3 one column shift", altgrOne, KeyState{level3: true, shift: true}, 0xd8},
+
+		{"no keysyms", nil, KeyState{shift: true}, 0},
+	}
+	for _, tt := range tests {
+		if got := chooseKeysym(tt.syms, tt.st); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeysymRune(t *testing.T) {
+	tests := []struct {
+		sym  uint32
+		want rune
+		ok   bool
+	}{
+		{'a', 'a', true},
+		{' ', ' ', true},
+		{0xe9, 'é', true},
+		{0x01a3, 'Ł', true},
+		{0x06c1, 'а', true},
+		{0x20ac, '€', true},
+		{keysymUnicodeOffset + 0x263a, '☺', true},
+		{keysymUnicodeOffset + 0x1f600, '😀', true},
+		{KEY_BACKSPACE, 0, false},
+		{KEY_F1, 0, false},
+		{keysymUnicodeOffset + 0xd800, 0, false},
+		{keysymUnicodeOffset + 0x110000, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := keysymRune(tt.sym)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("keysymRune(%#x) = %q, %v, want %q, %v", tt.sym, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	for _, r := range []rune{'a', '~', 'é', 'ÿ', 'Ł', '€', '😀'} {
+		sym := runeKeysym(r)
+		if got, ok := keysymRune(sym); !ok || got != r {
+			t.Errorf("keysymRune(runeKeysym(%q)) = %q, %v", r, got, ok)
+		}
+	}
+	if got := runeKeysym('€'); got != keysymUnicodeOffset+0x20ac {
+		t.Errorf("runeKeysym('€') = %#x, want the Unicode keysym", got)
+	}
+}
@@ -2,222 +2,534 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
-	"log"
+	"unicode/utf8"
 )
 
+const (
+	// limits on how much of a sequence we are prepared to buffer;
+	// anything longer is malformed or hostile and gets dropped
+	maxParams        = 32
+	maxIntermediates = 4
+	maxStringLength  = 1 << 16
+	maxTextLength    = 4096
+)
+
+// Lexer is a DEC/ECMA-48 parser modelled on the VT500 state
+// machine described by Paul Williams (https://vt100.net/emu/dec_ansi_parser).
+// Rather than handing out raw bytes it dispatches structured
+// tokens: runs of printable text, C0 controls, and escape, CSI,
+// OSC and DCS sequences with their parameters already parsed.
 type Lexer struct {
 	reader    *bufio.Reader
 	tokenChan chan Token
 	char      byte
-	peek      byte
+	state     State
+
+	// sequence being collected
+	private       byte
+	intermediates []byte
+	params        []int
+	subParams     [][]int
+	param         int
+	inSub         bool
+	final         byte
+	data          []byte
+	overflow      bool
+	text          []rune
+
+	// partially decoded UTF-8 sequence
+	utf8Buf  [utf8.UTFMax]byte
+	utf8Len  int
+	utf8Need int
 }
 
 func NewLexer(reader *bufio.Reader, tokenChan chan Token) *Lexer {
-	lexer := &Lexer{reader: reader, tokenChan: tokenChan}
+	lexer := &Lexer{reader: reader, tokenChan: tokenChan, state: GROUND}
 	go lexer.Token()
 	return lexer
 }
 
 type Token struct {
-	Type    TokenType
-	Literal []byte
+	Type          TokenType
+	Final         byte
+	Private       byte
+	Intermediates []byte
+	// Params holds the semicolon separated parameters. A missing
+	// parameter is reported as 0.
+	Params []int
+	// SubParams[i] holds the colon separated sub-parameters that
+	// followed Params[i], or nil if there were none.
+	SubParams [][]int
+	Literal   []byte
+	// Runes holds the decoded characters of a TEXT token.
+	Runes []rune
+	// Err is set on END_OF_STREAM when reading failed for a
+	// reason other than io.EOF.
+	Err error
 }
 
 type TokenType string
 
 const (
-	TEXT                    TokenType = "TEXT"
-	CLEAR_SCREEN            TokenType = "CLEAR_SCREEN"
-	BAR                     TokenType = "BAR"
-	COLOR_CODE              TokenType = "COLOR_CODE"
-	CRLF                    TokenType = "CRLF"
-	CR                      TokenType = "CR"
-	LF                      TokenType = "LF"
-	RESET_CURSOR            TokenType = "RESET_CURSOR"
-	CLEAR                   TokenType = "CLEAR"
-	BACKSPACE               TokenType = "BACKSPACE"
-	OSC                     TokenType = "OSC"
-	CURSOR_ROW              TokenType = "CURSOR_ROW"
-	CURSOR_POSITION_REQUEST TokenType = "CURSOR_POSITION_REQUEST"
-	DEVICE_CONTROL_STRING   TokenType = "DEVICE_CONTROL_STRING"
-	RESET_INITIAL_STATE     TokenType = "RESET_INITIAL_STATE"
-	INSERT_LINE             TokenType = "INSERT_LINE"
-	DELETE_LINES            TokenType = "DELETE_LINES"
-	DELETE_CHARS            TokenType = "DELETE_CHARS"
-	MOVE_TO_COL             TokenType = "MOVE_TO_COL"
-	CLEAR_LINE              TokenType = "CLEAR_LINE"
+	TEXT                  TokenType = "TEXT"
+	CONTROL               TokenType = "CONTROL"
+	ESCAPE                TokenType = "ESCAPE"
+	CSI                   TokenType = "CSI"
+	OSC                   TokenType = "OSC"
+	DEVICE_CONTROL_STRING TokenType = "DEVICE_CONTROL_STRING"
+	END_OF_STREAM         TokenType = "END_OF_STREAM"
 )
 
+// Param returns the i'th parameter, or def if it is missing or zero.
+func (token Token) Param(i, def int) int {
+	if i >= len(token.Params) || token.Params[i] == 0 {
+		return def
+	}
+	return token.Params[i]
+}
+
+// Sub returns the colon separated sub-parameters of the i'th parameter.
+func (token Token) Sub(i int) []int {
+	if i >= len(token.SubParams) {
+		return nil
+	}
+	return token.SubParams[i]
+}
+
+func (token Token) String() string {
+	switch token.Type {
+	case TEXT:
+		return fmt.Sprintf("%s %q", token.Type, string(token.Runes))
+	case OSC:
+		return fmt.Sprintf("%s %q", token.Type, token.Literal)
+	case CONTROL:
+		return fmt.Sprintf("%s 0x%02x", token.Type, token.Final)
+	case END_OF_STREAM:
+		return fmt.Sprintf("%s %v", token.Type, token.Err)
+	}
+	s := string(token.Type) + " "
+	if token.Private != 0 {
+		s += string(token.Private)
+	}
+	for i, p := range token.Params {
+		if i > 0 {
+			s += ";"
+		}
+		s += fmt.Sprint(p)
+		for _, sp := range token.Sub(i) {
+			s += fmt.Sprintf(":%d", sp)
+		}
+	}
+	s += string(token.Intermediates) + string(token.Final)
+	if len(token.Literal) > 0 {
+		s += fmt.Sprintf(" %q", token.Literal)
+	}
+	return s
+}
+
 type State string
 
 const (
-	INITIAL                  State = "INITIAL"
-	ESCAPE_SEQUENCE          State = "ESCAPE_SEQUENCE"
-	ANSI_SEQUENCE            State = "ANSI_SEQUENCE"
-	EPSON_SEQUENCE           State = "EPSON_SEQUENCE"
-	IN_TEXT                  State = "IN_TEXT"
-	IN_NEWLINE               State = "IN_NEWLINE"
-	OPERATING_SYSTEM_COMMAND State = "OPERATING_SYSTEM_COMMAND"
-	DCS                      State = "DCS"
-	DCS_TERMINATE            State = "DCS_TERMINATE"
+	GROUND              State = "GROUND"
+	ESCAPE_STATE        State = "ESCAPE"
+	ESCAPE_INTERMEDIATE State = "ESCAPE_INTERMEDIATE"
+	CSI_ENTRY           State = "CSI_ENTRY"
+	CSI_PARAM           State = "CSI_PARAM"
+	CSI_INTERMEDIATE    State = "CSI_INTERMEDIATE"
+	CSI_IGNORE          State = "CSI_IGNORE"
+	DCS_ENTRY           State = "DCS_ENTRY"
+	DCS_PARAM           State = "DCS_PARAM"
+	DCS_INTERMEDIATE    State = "DCS_INTERMEDIATE"
+	DCS_PASSTHROUGH     State = "DCS_PASSTHROUGH"
+	DCS_IGNORE          State = "DCS_IGNORE"
+	OSC_STRING          State = "OSC_STRING"
+	SOS_PM_APC_STRING   State = "SOS_PM_APC_STRING"
 )
 
-var state = INITIAL
-
-func (lexer *Lexer) ReadChar() {
+func (lexer *Lexer) ReadChar() error {
 	r, err := lexer.reader.ReadByte()
 	if err != nil {
-		if err == io.EOF {
-			close(lexer.tokenChan)
-		}
-		log.Fatal("reader error: ", err)
+		return err
 	}
 	lexer.char = r
+	return nil
 }
 
+// Token reads until the underlying reader fails, then sends a final
+// END_OF_STREAM token and closes the channel.
 func (lexer *Lexer) Token() {
-	var literal []byte
-	i := 0
+	defer close(lexer.tokenChan)
 	for {
-		lexer.ReadChar()
-		i += 1
+		if err := lexer.ReadChar(); err != nil {
+			lexer.flushText()
+			if err == io.EOF {
+				err = nil
+			}
+			lexer.emit(Token{Type: END_OF_STREAM, Err: err})
+			return
+		}
+		lexer.Advance(lexer.char)
 
-		literal = append(literal, lexer.char)
+		// hand text over once we have drained what is buffered,
+		// so that a run of output becomes a single token
+		if lexer.reader.Buffered() == 0 || len(lexer.text) >= maxTextLength {
+			lexer.flushText()
+		}
+	}
+}
 
-		switch state {
-		case INITIAL:
-			if lexer.char == '\033' {
-				state = ESCAPE_SEQUENCE
+// Advance feeds a single byte through the state machine.
+func (lexer *Lexer) Advance(c byte) {
+	if lexer.utf8Need > 0 {
+		if c&0xc0 == 0x80 {
+			lexer.decode(c)
+			return
+		}
+		// sequence cut short; the byte that interrupted it
+		// is processed normally
+		lexer.utf8Need = 0
+		lexer.addText(utf8.RuneError)
+	}
+
+	// transitions from anywhere
+	switch {
+	case c == 0x18 || c == 0x1a:
+		lexer.flushText()
+		lexer.emit(Token{Type: CONTROL, Final: c})
+		lexer.state = GROUND
+		return
+	case c == 0x1b:
+		lexer.flushText()
+		lexer.leave()
+		lexer.clear()
+		lexer.state = ESCAPE_STATE
+		return
+	}
+
+	switch lexer.state {
+	case GROUND:
+		switch {
+		case c < 0x20:
+			lexer.flushText()
+			lexer.emit(Token{Type: CONTROL, Final: c})
+		case c == 0x7f:
+		case c < 0x80:
+			lexer.addText(rune(c))
+		default:
+			// bytes above 0x7f start a UTF-8 sequence; 8-bit C1
+			// controls are not recognised
+			lexer.decode(c)
+		}
+
+	case ESCAPE_STATE:
+		switch {
+		case c < 0x20:
+			lexer.emit(Token{Type: CONTROL, Final: c})
+		case c < 0x30:
+			lexer.collect(c)
+			lexer.state = ESCAPE_INTERMEDIATE
+		case c == '[':
+			lexer.state = CSI_ENTRY
+		case c == ']':
+			lexer.state = OSC_STRING
+		case c == 'P':
+			lexer.state = DCS_ENTRY
+		case c == 'X' || c == '^' || c == '_':
+			lexer.state = SOS_PM_APC_STRING
+		case c == 0x7f:
+		default:
+			lexer.escDispatch(c)
+			lexer.state = GROUND
+		}
+
+	case ESCAPE_INTERMEDIATE:
+		switch {
+		case c < 0x20:
+			lexer.emit(Token{Type: CONTROL, Final: c})
+		case c < 0x30:
+			lexer.collect(c)
+		case c == 0x7f:
+		default:
+			lexer.escDispatch(c)
+			lexer.state = GROUND
+		}
+
+	case CSI_ENTRY, CSI_PARAM:
+		switch {
+		case c < 0x20:
+			lexer.emit(Token{Type: CONTROL, Final: c})
+		case c < 0x30:
+			lexer.collect(c)
+			lexer.state = CSI_INTERMEDIATE
+		case c <= ';':
+			lexer.addParam(c)
+			lexer.state = CSI_PARAM
+		case c < 0x40:
+			if lexer.state == CSI_PARAM {
+				lexer.state = CSI_IGNORE
 			} else {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: TEXT, Literal: literal}
-				literal = []byte{}
-			}
-		case DCS:
-			if lexer.char == '\033' {
-				state = DCS_TERMINATE
-			}
-		case DCS_TERMINATE:
-			if lexer.char == '\\' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: DEVICE_CONTROL_STRING, Literal: literal}
-				literal = []byte{}
-			}
-		case ESCAPE_SEQUENCE:
-			if lexer.char == '(' {
-				state = EPSON_SEQUENCE
-			}
-			if lexer.char == '[' {
-				state = ANSI_SEQUENCE
-			}
-			if lexer.char == ']' {
-				state = OPERATING_SYSTEM_COMMAND
-			}
-			if lexer.char == '=' || lexer.char == '>' {
-				literal = []byte{}
-				state = INITIAL
+				lexer.private = c
+				lexer.state = CSI_PARAM
 			}
+		case c == 0x7f:
+		default:
+			lexer.csiDispatch(c)
+			lexer.state = GROUND
+		}
 
-			if lexer.char == 'P' {
-				state = DCS // device control string
-			}
+	case CSI_INTERMEDIATE:
+		switch {
+		case c < 0x20:
+			lexer.emit(Token{Type: CONTROL, Final: c})
+		case c < 0x30:
+			lexer.collect(c)
+		case c < 0x40:
+			lexer.state = CSI_IGNORE
+		case c == 0x7f:
+		default:
+			lexer.csiDispatch(c)
+			lexer.state = GROUND
+		}
 
-			if lexer.char == 'M' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: DELETE_LINES, Literal: literal}
-				literal = []byte{}
-			}
+	case CSI_IGNORE:
+		switch {
+		case c < 0x20:
+			lexer.emit(Token{Type: CONTROL, Final: c})
+		case c >= 0x40 && c < 0x7f:
+			lexer.state = GROUND
+		}
 
-		case ANSI_SEQUENCE:
-			if lexer.char == 'L' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: INSERT_LINE, Literal: literal}
-				literal = []byte{}
+	case DCS_ENTRY, DCS_PARAM:
+		switch {
+		case c < 0x20:
+		case c < 0x30:
+			lexer.collect(c)
+			lexer.state = DCS_INTERMEDIATE
+		case c <= ';':
+			lexer.addParam(c)
+			lexer.state = DCS_PARAM
+		case c < 0x40:
+			if lexer.state == DCS_PARAM {
+				lexer.state = DCS_IGNORE
+			} else {
+				lexer.private = c
+				lexer.state = DCS_PARAM
 			}
+		case c == 0x7f:
+		default:
+			lexer.hook(c)
+			lexer.state = DCS_PASSTHROUGH
+		}
 
-			if lexer.char == 'H' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: RESET_CURSOR, Literal: literal}
-				literal = []byte{}
-			}
-			if lexer.char == 'J' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: CLEAR, Literal: literal}
-				literal = []byte{}
-			}
+	case DCS_INTERMEDIATE:
+		switch {
+		case c < 0x20:
+		case c < 0x30:
+			lexer.collect(c)
+		case c < 0x40:
+			lexer.state = DCS_IGNORE
+		case c == 0x7f:
+		default:
+			lexer.hook(c)
+			lexer.state = DCS_PASSTHROUGH
+		}
 
-			// move to row
-			if lexer.char == 'd' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: CURSOR_ROW, Literal: literal}
-				literal = []byte{}
-			}
+	case DCS_PASSTHROUGH:
+		if c != 0x7f {
+			lexer.put(c)
+		}
 
-			if lexer.char == 'n' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: CURSOR_POSITION_REQUEST, Literal: literal}
-				literal = []byte{}
-			}
+	case DCS_IGNORE:
 
-			if lexer.char == 'c' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: RESET_INITIAL_STATE, Literal: literal}
-				literal = []byte{}
-			}
+	case OSC_STRING:
+		switch {
+		case c == 0x07:
+			lexer.leave()
+			lexer.state = GROUND
+		case c < 0x20:
+		default:
+			lexer.put(c)
+		}
 
-			if lexer.char == 'P' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: DELETE_CHARS, Literal: literal}
-				literal = []byte{}
-			}
+	case SOS_PM_APC_STRING:
+	}
+}
 
-			if lexer.char == 'G' || lexer.char == '`' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: MOVE_TO_COL, Literal: literal}
-				literal = []byte{}
-			}
+// leave performs the exit action of the current state when it is
+// ended by ESC or BEL. CAN and SUB drop the sequence instead.
+func (lexer *Lexer) leave() {
+	if lexer.overflow {
+		return
+	}
+	switch lexer.state {
+	case OSC_STRING:
+		lexer.emit(Token{Type: OSC, Literal: lexer.data})
+	case DCS_PASSTHROUGH:
+		lexer.emit(Token{
+			Type:          DEVICE_CONTROL_STRING,
+			Final:         lexer.final,
+			Private:       lexer.private,
+			Intermediates: lexer.intermediates,
+			Params:        lexer.params,
+			SubParams:     lexer.subParams,
+			Literal:       lexer.data,
+		})
+	}
+}
 
-			if lexer.char == 'K' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: CLEAR_LINE, Literal: literal}
-				literal = []byte{}
-			}
+func (lexer *Lexer) clear() {
+	lexer.private = 0
+	lexer.intermediates = nil
+	lexer.params = nil
+	lexer.subParams = nil
+	lexer.param = 0
+	lexer.inSub = false
+	lexer.data = nil
+	lexer.overflow = false
+}
 
-			if lexer.char == 'm' || lexer.char == 'l' || lexer.char == 'h' || lexer.char == 'f' || lexer.char == '@' || lexer.char == 'C' || lexer.char == 't' || lexer.char == 'r' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: COLOR_CODE, Literal: literal}
-				literal = []byte{}
-			}
+func (lexer *Lexer) collect(c byte) {
+	if len(lexer.intermediates) >= maxIntermediates {
+		lexer.overflow = true
+		return
+	}
+	lexer.intermediates = append(lexer.intermediates, c)
+}
 
-		case EPSON_SEQUENCE:
-			if lexer.char == 'B' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: BAR, Literal: literal}
-				literal = []byte{}
-			}
-		case OPERATING_SYSTEM_COMMAND:
-			if lexer.char == '\a' {
-				state = IN_TEXT
-				lexer.tokenChan <- Token{Type: OSC, Literal: literal}
-				literal = []byte{}
-			}
-		case IN_TEXT:
-			if lexer.char == '\r' {
-				lexer.tokenChan <- Token{Type: CR, Literal: []byte{lexer.char}}
-				literal = []byte{}
-			} else if lexer.char == '\n' {
-				lexer.tokenChan <- Token{Type: LF, Literal: []byte{lexer.char}}
-				literal = []byte{}
-			} else if lexer.char == '\033' {
-				state = ESCAPE_SEQUENCE
-			} else if lexer.char == 0x08 {
-				lexer.tokenChan <- Token{Type: BACKSPACE, Literal: literal}
-				literal = []byte{}
-			} else {
-				lexer.tokenChan <- Token{Type: TEXT, Literal: literal}
-				literal = []byte{}
-			}
+// put appends to an OSC or DCS string.
+func (lexer *Lexer) put(c byte) {
+	if len(lexer.data) >= maxStringLength {
+		lexer.overflow = true
+		return
+	}
+	lexer.data = append(lexer.data, c)
+}
+
+// addParam handles a digit, ':' or ';' inside a parameter string.
+func (lexer *Lexer) addParam(c byte) {
+	if len(lexer.params) == 0 {
+		// first parameter byte; reserve the slot
+		lexer.params = append(lexer.params, 0)
+		lexer.subParams = append(lexer.subParams, nil)
+	}
+	last := len(lexer.params) - 1
+
+	switch c {
+	case ';':
+		lexer.endParam()
+		if len(lexer.params) >= maxParams {
+			lexer.overflow = true
+			return
+		}
+		lexer.params = append(lexer.params, 0)
+		lexer.subParams = append(lexer.subParams, nil)
+	case ':':
+		lexer.endParam()
+		if len(lexer.subParams[last]) >= maxParams {
+			lexer.overflow = true
+			return
+		}
+		lexer.inSub = true
+	default:
+		lexer.param = lexer.param*10 + int(c-'0')
+		if lexer.param > 65535 {
+			lexer.param = 65535
+		}
+		if !lexer.inSub {
+			lexer.params[last] = lexer.param
 		}
 	}
 }
+
+// endParam closes the value being accumulated.
+func (lexer *Lexer) endParam() {
+	last := len(lexer.params) - 1
+	if lexer.inSub {
+		lexer.subParams[last] = append(lexer.subParams[last], lexer.param)
+	} else {
+		lexer.params[last] = lexer.param
+	}
+	lexer.param = 0
+	lexer.inSub = false
+}
+
+func (lexer *Lexer) finishParams() {
+	if len(lexer.params) > 0 {
+		lexer.endParam()
+	}
+}
+
+func (lexer *Lexer) escDispatch(c byte) {
+	if lexer.overflow {
+		return
+	}
+	lexer.emit(Token{Type: ESCAPE, Final: c, Intermediates: lexer.intermediates})
+}
+
+func (lexer *Lexer) csiDispatch(c byte) {
+	lexer.finishParams()
+	if lexer.overflow {
+		return
+	}
+	lexer.emit(Token{
+		Type:          CSI,
+		Final:         c,
+		Private:       lexer.private,
+		Intermediates: lexer.intermediates,
+		Params:        lexer.params,
+		SubParams:     lexer.subParams,
+	})
+}
+
+func (lexer *Lexer) hook(c byte) {
+	lexer.finishParams()
+	lexer.final = c
+}
+
+// decode accumulates a UTF-8 sequence one byte at a time so that
+// characters split across reads still come out whole. Invalid
+// sequences are replaced with U+FFFD.
+func (lexer *Lexer) decode(c byte) {
+	if lexer.utf8Need == 0 {
+		switch {
+		case c >= 0xc2 && c <= 0xdf:
+			lexer.utf8Need = 2
+		case c >= 0xe0 && c <= 0xef:
+			lexer.utf8Need = 3
+		case c >= 0xf0 && c <= 0xf4:
+			lexer.utf8Need = 4
+		default:
+			lexer.addText(utf8.RuneError)
+			return
+		}
+		lexer.utf8Len = 0
+	}
+
+	lexer.utf8Buf[lexer.utf8Len] = c
+	lexer.utf8Len++
+	if lexer.utf8Len < lexer.utf8Need {
+		return
+	}
+
+	r, _ := utf8.DecodeRune(lexer.utf8Buf[:lexer.utf8Len])
+	lexer.utf8Need = 0
+	lexer.addText(r)
+}
+
+func (lexer *Lexer) addText(r rune) {
+	lexer.text = append(lexer.text, r)
+}
+
+func (lexer *Lexer) flushText() {
+	if len(lexer.text) == 0 {
+		return
+	}
+	lexer.emit(Token{Type: TEXT, Runes: lexer.text})
+	lexer.text = nil
+}
+
+func (lexer *Lexer) emit(token Token) {
+	lexer.tokenChan <- token
+}
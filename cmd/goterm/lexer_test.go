@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// lex runs the lexer over everything r returns and gives back the
+// tokens as strings, leaving off the END_OF_STREAM token.
+func lex(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	ch := make(chan Token, 100000)
+	lexer := &Lexer{reader: bufio.NewReader(r), tokenChan: ch, state: GROUND}
+	lexer.Token()
+
+	var tokens []string
+	var last Token
+	for token := range ch {
+		tokens = append(tokens, token.String())
+		last = token
+	}
+	if last.Type != END_OF_STREAM {
+		t.Fatalf("last token is %v, not END_OF_STREAM", last)
+	}
+	return tokens[:len(tokens)-1]
+}
+
+func TestLexer(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"text", "hello", []string{`TEXT "hello"`}},
+		{"controls", "a\r\nb", []string{`TEXT "a"`, "CONTROL 0x0d", "CONTROL 0x0a", `TEXT "b"`}},
+		{"DEL in text", "a\x7fb", []string{`TEXT "ab"`}},
+
+		// CSI parameters
+		{"CSI", "\x1b[1;22H", []string{"CSI 1;22H"}},
+		{"CSI no params", "\x1b[m", []string{"CSI m"}},
+		{"CSI missing param", "\x1b[;5H", []string{"CSI 0;5H"}},
+		{"CSI trailing semicolon", "\x1b[1;m", []string{"CSI 1;0m"}},
+		{"CSI private", "\x1b[?1049h", []string{"CSI ?1049h"}},
+		{"CSI greater than", "\x1b[>4;2m", []string{"CSI >4;2m"}},
+		{"CSI intermediate", "\x1b[!p", []string{"CSI !p"}},
+		{"CSI private and intermediate", "\x1b[?2004$p", []string{"CSI ?2004$p"}},
+		{"CSI big param", "\x1b[99999999A", []string{"CSI 65535A"}},
+		{"CSI sub-params", "\x1b[4:3m", []string{"CSI 4:3m"}},
+		{"CSI empty sub-param", "\x1b[38:2::255:0:0m", []string{"CSI 38:2:0:255:0:0m"}},
+		{"CSI mixed sub-params", "\x1b[1;58:5:196;4:0m", []string{"CSI 1;58:5:196;4:0m"}},
+		{"CSI control inside", "\x1b[1\n2H", []string{"CONTROL 0x0a", "CSI 12H"}},
+		{"CSI DEL inside", "\x1b[1\x7f2H", []string{"CSI 12H"}},
+
+		// CSI_IGNORE swallows the rest of a malformed sequence
+		{"CSI private after param", "\x1b[1?2hX", []string{`TEXT "X"`}},
+		{"CSI param after intermediate", "\x1b[1$2pX", []string{`TEXT "X"`}},
+		{"CSI control while ignoring", "\x1b[1?\r2hX", []string{"CONTROL 0x0d", `TEXT "X"`}},
+
+		// escapes
+		{"ESC", "\x1b7", []string{"ESCAPE 7"}},
+		{"ESC intermediate", "\x1b(0", []string{"ESCAPE (0"}},
+		{"ESC restarts a sequence", "\x1b[1\x1b[2J", []string{"CSI 2J"}},
+
+		// OSC ended by BEL or ST
+		{"OSC BEL", "\x1b]0;title\x07", []string{`OSC "0;title"`}},
+		{"OSC ST", "\x1b]2;title\x1b\\", []string{`OSC "2;title"`, `ESCAPE \`}},
+		{"OSC UTF-8", "\x1b]2;\xe4\xb8\xad\x07", []string{`OSC "2;中"`}},
+		{"OSC controls dropped", "\x1b]2;a\nb\x07", []string{`OSC "2;ab"`}},
+
+		// DCS, and SOS/PM/APC which are ignored
+		{"DCS", "\x1bP1$qm\x1b\\", []string{`DEVICE_CONTROL_STRING 1$q "m"`, `ESCAPE \`}},
+		{"APC", "\x1b_abc\x1b\\x", []string{`ESCAPE \`, `TEXT "x"`}},
+		{"PM ends only with ST", "\x1b^abc\x07x\x1b\\y", []string{`ESCAPE \`, `TEXT "y"`}},
+
+		// CAN and SUB abort whatever is in progress
+		{"CAN in CSI", "\x1b[12\x18A", []string{"CONTROL 0x18", `TEXT "A"`}},
+		{"SUB in CSI", "\x1b[12\x1aA", []string{"CONTROL 0x1a", `TEXT "A"`}},
+		{"CAN in ESC", "\x1b(\x180", []string{"CONTROL 0x18", `TEXT "0"`}},
+		{"CAN in OSC", "\x1b]0;x\x18A", []string{"CONTROL 0x18", `TEXT "A"`}},
+		{"SUB in DCS", "\x1bPqabc\x1aA", []string{"CONTROL 0x1a", `TEXT "A"`}},
+
+		// sequences past the limits are dropped whole
+		{"too many params", "\x1b[" + strings.Repeat("1;", maxParams) + "mx", []string{`TEXT "x"`}},
+		{"params at the limit", "\x1b[" + strings.Repeat("1;", maxParams-1) + "1m",
+			[]string{"CSI " + strings.Repeat("1;", maxParams-1) + "1m"}},
+		{"too many sub-params", "\x1b[4" + strings.Repeat(":1", maxParams+1) + "mx", []string{`TEXT "x"`}},
+		{"too many CSI intermediates", "\x1b[" + strings.Repeat("!", maxIntermediates+1) + "px", []string{`TEXT "x"`}},
+		{"too many ESC intermediates", "\x1b" + strings.Repeat("(", maxIntermediates+1) + "0x", []string{`TEXT "x"`}},
+		{"OSC too long", "\x1b]0;" + strings.Repeat("a", maxStringLength) + "\x07x", []string{`TEXT "x"`}},
+		{"overflow reset", "\x1b[" + strings.Repeat("!", maxIntermediates+1) + "p\x1b[1m", []string{"CSI 1m"}},
+
+		// UTF-8
+		{"UTF-8", "é中😀", []string{`TEXT "é中😀"`}},
+		{"invalid byte", "a\xffb", []string{`TEXT "a�b"`}},
+		{"stray continuation", "\x80", []string{`TEXT "�"`}},
+		{"overlong", "\xc0\xaf", []string{`TEXT "��"`}},
+		{"surrogate", "\xed\xa0\x80", []string{`TEXT "�"`}},
+		{"truncated", "\xe4\xb8A", []string{`TEXT "�A"`}},
+		{"truncated by ESC", "\xe4\x1b[mA", []string{`TEXT "�"`, "CSI m", `TEXT "A"`}},
+		{"8-bit CSI is text", "\x9b1m", []string{`TEXT "�1m"`}},
+	}
+	for _, tt := range tests {
+		got := lex(t, strings.NewReader(tt.input))
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLexerSplitReads(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"UTF-8", []string{"a\xe4", "\xb8\xad"}, []string{`TEXT "a"`, `TEXT "中"`}},
+		{"UTF-8 in three", []string{"\xf0\x9f", "\x98", "\x80b"}, []string{`TEXT "😀b"`}},
+		{"CSI", []string{"\x1b[1", ";2", "H"}, []string{"CSI 1;2H"}},
+		{"OSC", []string{"\x1b]0;ti", "tle\x1b", "\\"}, []string{`OSC "0;title"`, `ESCAPE \`}},
+	}
+	for _, tt := range tests {
+		var readers []io.Reader
+		for _, c := range tt.chunks {
+			readers = append(readers, strings.NewReader(c))
+		}
+		got := lex(t, io.MultiReader(readers...))
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLexerReadError(t *testing.T) {
+	boom := errors.New("boom")
+	ch := make(chan Token, 10)
+	r := io.MultiReader(strings.NewReader("ab\xe4"), iotest.ErrReader(boom))
+	lexer := &Lexer{reader: bufio.NewReader(r), tokenChan: ch, state: GROUND}
+	lexer.Token()
+
+	var tokens []Token
+	for token := range ch {
+		tokens = append(tokens, token)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("got %v, want TEXT and END_OF_STREAM", tokens)
+	}
+	if got := string(tokens[0].Runes); got != "ab" {
+		t.Errorf("text: got %q, want %q", got, "ab")
+	}
+	if tokens[1].Type != END_OF_STREAM || tokens[1].Err != boom {
+		t.Errorf("end: got %v, want END_OF_STREAM boom", tokens[1])
+	}
+
+	// EOF isn't an error
+	tokens = nil
+	ch = make(chan Token, 10)
+	lexer = &Lexer{reader: bufio.NewReader(strings.NewReader("x")), tokenChan: ch, state: GROUND}
+	lexer.Token()
+	for token := range ch {
+		tokens = append(tokens, token)
+	}
+	if len(tokens) != 2 || tokens[1].Type != END_OF_STREAM || tokens[1].Err != nil {
+		t.Errorf("got %v, want TEXT and a clean END_OF_STREAM", tokens)
+	}
+}
+
+func TestTokenParam(t *testing.T) {
+	token := Token{Params: []int{0, 7}, SubParams: [][]int{nil, {2, 5}}}
+	if got := token.Param(0, 1); got != 1 {
+		t.Errorf("Param(0, 1) = %d, want the default 1", got)
+	}
+	if got := token.Param(1, 1); got != 7 {
+		t.Errorf("Param(1, 1) = %d, want 7", got)
+	}
+	if got := token.Param(5, 3); got != 3 {
+		t.Errorf("Param(5, 3) = %d, want the default 3", got)
+	}
+	if got := token.Sub(1); len(got) != 2 || got[0] != 2 || got[1] != 5 {
+		t.Errorf("Sub(1) = %v, want [2 5]", got)
+	}
+	if got := token.Sub(4); got != nil {
+		t.Errorf("Sub(4) = %v, want nil", got)
+	}
+}
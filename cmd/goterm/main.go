@@ -23,6 +23,8 @@ var (
 	sshClient  = flag.Bool("ssh", false, "enable ssh client")
 	user       = flag.String("u", "", "ssh user")
 	host       = flag.String("h", "", "ssh host:port")
+	theme      = flag.String("theme", "light", "color theme: light, dark or the path to a theme file")
+	scrollback = flag.Int("scrollback", 1000, "lines of history to keep")
 )
 
 func (s *SSH) Read(p []byte) (n int, err error) {
@@ -60,6 +62,11 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	palette, err := LoadTheme(*theme)
+	if err != nil {
+		log.Fatal("failed to load theme: ", err)
+	}
+
 	width := 120
 	height := 34
 	var gui = &XGBGui{}
@@ -124,7 +131,7 @@ func main() {
 		time.Sleep(1 * time.Second)
 		//		session.Run("/bin/bash")
 
-		_, err = NewTerminal(s, gui, width, height)
+		_, err = NewTerminal(s, gui, palette, width, height)
 		if err != nil {
 			log.Fatal("failed to start terminal:", err)
 		}
@@ -144,7 +151,7 @@ func main() {
 			Y:    0,
 		})
 
-		_, err = NewTerminal(localPty, gui, width, height)
+		_, err = NewTerminal(localPty, gui, palette, width, height)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,138 @@
+package main
+
+// setModes handles SM (CSI Pm h) and RM (CSI Pm l).
+func (term *Terminal) setModes(token Token, on bool) {
+	for _, mode := range token.Params {
+		switch mode {
+		case 4:
+			// IRM
+			term.insertMode = on
+		}
+	}
+}
+
+// modeState reports an ANSI mode for DECRQM.
+func (term *Terminal) modeState(mode int) int {
+	switch mode {
+	case 4:
+		return modeValue(term.insertMode)
+	case 20:
+		// LNM: newlines never imply a carriage return
+		return MODE_PERMANENTLY_RESET
+	}
+	return MODE_NOT_RECOGNIZED
+}
+
+// setPrivateModes handles DECSET (CSI ? Pm h) and DECRST (CSI ? Pm l).
+func (term *Terminal) setPrivateModes(token Token, on bool) {
+	for _, mode := range token.Params {
+		switch mode {
+		case 1:
+			// DECCKM
+			term.appCursorKeys = on
+		case 6:
+			// DECOM; the cursor goes home either way
+			term.originMode = on
+			term.moveTo(0, 0)
+		case 7:
+			term.autowrap = on
+			if !on {
+				term.wrapPending = false
+			}
+		case 66:
+			// DECNKM, the same as DECKPAM and DECKPNM
+			term.appKeypad = on
+		case MOUSE_X10, MOUSE_NORMAL, MOUSE_BUTTON, MOUSE_ANY:
+			term.setMouseMode(mode, on)
+		case MOUSE_ENCODING_UTF8, MOUSE_ENCODING_SGR, MOUSE_ENCODING_URXVT:
+			term.setMouseEncoding(mode, on)
+		case 2004:
+			term.bracketedPaste = on
+		case 47:
+			term.useAltScreen(on)
+		case 1047:
+			if !on && term.altScreen {
+				term.ClearRegion(0, 0, term.width-1, term.height-1, false)
+			}
+			term.useAltScreen(on)
+		case 1049:
+			if on {
+				term.saveCursor()
+				term.useAltScreen(true)
+				term.ClearRegion(0, 0, term.width-1, term.height-1, false)
+			} else {
+				term.useAltScreen(false)
+				term.restoreCursor()
+			}
+		}
+	}
+}
+
+// privateModeState reports a DEC private mode for DECRQM.
+func (term *Terminal) privateModeState(mode int) int {
+	switch mode {
+	case 1:
+		return modeValue(term.appCursorKeys)
+	case 6:
+		return modeValue(term.originMode)
+	case 7:
+		return modeValue(term.autowrap)
+	case 66:
+		return modeValue(term.appKeypad)
+	case MOUSE_X10, MOUSE_NORMAL, MOUSE_BUTTON, MOUSE_ANY:
+		return modeValue(term.mouseMode == mode)
+	case MOUSE_ENCODING_UTF8, MOUSE_ENCODING_SGR, MOUSE_ENCODING_URXVT:
+		return modeValue(term.mouseEncoding == mode)
+	case 2004:
+		return modeValue(term.bracketedPaste)
+	case 47, 1047, 1049:
+		return modeValue(term.altScreen)
+	}
+	return MODE_NOT_RECOGNIZED
+}
+
+// useAltScreen switches between the primary and alternate screens.
+func (term *Terminal) useAltScreen(on bool) {
+	if on == term.altScreen {
+		return
+	}
+	term.ui.EraseCursor(term)
+	term.snapToBottom()
+	term.ClearSelection()
+	term.glyphs, term.altGlyphs = term.altGlyphs, term.glyphs
+	term.wrapped, term.altWrapped = term.altWrapped, term.wrapped
+	term.altScreen = on
+	term.dirtyRange(0, term.height-1)
+}
+
+// screenIndex picks the savedCursors slot for the active screen.
+func (term *Terminal) screenIndex() int {
+	if term.altScreen {
+		return 1
+	}
+	return 0
+}
+
+func (term *Terminal) saveCursor() {
+	term.savedCursors[term.screenIndex()] = SavedCursor{
+		X:           term.cursor.X,
+		Y:           term.cursor.Y,
+		style:       term.style,
+		originMode:  term.originMode,
+		wrapPending: term.wrapPending,
+		charsets:    term.charsets,
+		charsetGL:   term.charsetGL,
+	}
+}
+
+// restoreCursor brings back what saveCursor remembered, or homes the
+// cursor with default attributes if nothing was saved.
+func (term *Terminal) restoreCursor() {
+	saved := term.savedCursors[term.screenIndex()]
+	term.style = saved.style
+	term.originMode = saved.originMode
+	term.charsets = saved.charsets
+	term.charsetGL = saved.charsetGL
+	term.moveCursor(saved.X, saved.Y)
+	term.wrapPending = saved.wrapPending && term.autowrap
+}
@@ -0,0 +1,152 @@
+package main
+
+import "fmt"
+
+// mouse tracking modes, named by their DECSET numbers
+const (
+	MOUSE_NONE   = 0
+	MOUSE_X10    = 9
+	MOUSE_NORMAL = 1000
+	MOUSE_BUTTON = 1002
+	MOUSE_ANY    = 1003
+)
+
+// mouse report encodings
+const (
+	MOUSE_ENCODING_DEFAULT = 0
+	MOUSE_ENCODING_UTF8    = 1005
+	MOUSE_ENCODING_SGR     = 1006
+	MOUSE_ENCODING_URXVT   = 1015
+)
+
+// Mouse buttons as they are numbered in reports. The wheel is sent as
+// buttons 64 and up, and the extra buttons as 128 and up.
+const (
+	MOUSE_LEFT        = 0
+	MOUSE_MIDDLE      = 1
+	MOUSE_RIGHT       = 2
+	MOUSE_NO_BUTTON   = 3
+	MOUSE_WHEEL_UP    = 64
+	MOUSE_WHEEL_DOWN  = 65
+	MOUSE_WHEEL_LEFT  = 66
+	MOUSE_WHEEL_RIGHT = 67
+	MOUSE_BACK        = 128
+	MOUSE_FORWARD     = 129
+)
+
+// MouseEvent is a press, release or move of the pointer over a cell.
+type MouseEvent struct {
+	button  int
+	x, y    int
+	mods    KeyMods
+	release bool
+	motion  bool
+}
+
+// setMouseMode handles the DECSET modes that turn tracking on and off.
+// Only one tracking mode is active at a time.
+func (term *Terminal) setMouseMode(mode int, on bool) {
+	if on {
+		term.mouseMode = mode
+	} else if term.mouseMode == mode {
+		term.mouseMode = MOUSE_NONE
+	}
+	term.lastMouseX, term.lastMouseY = -1, -1
+}
+
+// setMouseEncoding is the same for the report encodings.
+func (term *Terminal) setMouseEncoding(encoding int, on bool) {
+	if on {
+		term.mouseEncoding = encoding
+	} else if term.mouseEncoding == encoding {
+		term.mouseEncoding = MOUSE_ENCODING_DEFAULT
+	}
+}
+
+// ReportMouse returns the report to send the program for ev, if any.
+// ok is false when mouse reporting is off and the UI should handle the
+// mouse itself. The report is written by the caller once it has let go
+// of term.mu, since the program may not be reading.
+func (term *Terminal) ReportMouse(ev MouseEvent) (report []byte, ok bool) {
+	if term.mouseMode == MOUSE_NONE {
+		return nil, false
+	}
+	return term.encodeMouse(ev), true
+}
+
+// encodeMouse returns the report for ev under the current modes, or
+// nil if the mode doesn't report it.
+func (term *Terminal) encodeMouse(ev MouseEvent) []byte {
+	wheel := ev.button >= MOUSE_WHEEL_UP && ev.button < MOUSE_BACK
+	switch term.mouseMode {
+	case MOUSE_X10:
+		if ev.release || ev.motion {
+			return nil
+		}
+		// X10 has no room for modifiers
+		ev.mods = 0
+	case MOUSE_NORMAL:
+		if ev.motion {
+			return nil
+		}
+	case MOUSE_BUTTON:
+		if ev.motion && ev.button == MOUSE_NO_BUTTON {
+			return nil
+		}
+	}
+	if ev.release && wheel {
+		// the wheel only clicks
+		return nil
+	}
+	if ev.motion {
+		if ev.x == term.lastMouseX && ev.y == term.lastMouseY {
+			return nil
+		}
+	}
+	term.lastMouseX, term.lastMouseY = ev.x, ev.y
+
+	cb := ev.button
+	if ev.mods&MOD_SHIFT != 0 {
+		cb |= 4
+	}
+	if ev.mods&MOD_ALT != 0 {
+		cb |= 8
+	}
+	if ev.mods&MOD_CTRL != 0 {
+		cb |= 16
+	}
+	if ev.motion {
+		cb |= 32
+	}
+	// reports count cells from 1
+	x, y := ev.x+1, ev.y+1
+
+	switch term.mouseEncoding {
+	case MOUSE_ENCODING_SGR:
+		final := 'M'
+		if ev.release {
+			final = 'm'
+		}
+		return []byte(fmt.Sprintf("\033[<%d;%d;%d%c", cb, x, y, final))
+	case MOUSE_ENCODING_URXVT:
+		if ev.release {
+			cb = cb&^3 | MOUSE_NO_BUTTON
+		}
+		return []byte(fmt.Sprintf("\033[%d;%d;%dM", 32+cb, x, y))
+	}
+
+	// the older encodings can't say which button was let go
+	if ev.release {
+		cb = cb&^3 | MOUSE_NO_BUTTON
+	}
+	if term.mouseEncoding == MOUSE_ENCODING_UTF8 {
+		if x > 2015 || y > 2015 {
+			return nil
+		}
+		return []byte(string([]rune{0x1b, '[', 'M', rune(32 + cb), rune(32 + x), rune(32 + y)}))
+	}
+	if x > 223 || y > 223 {
+		return nil
+	}
+	return []byte{0x1b, '[', 'M', byte(32 + cb), byte(32 + x), byte(32 + y)}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sheik/xgbutil/xgraphics"
+)
+
+// Palette is the set of colors a terminal is drawn with: the 256
+// indexed colors plus the defaults used when nothing else is set.
+type Palette struct {
+	colors [256]xgraphics.BGRA
+
+	foreground xgraphics.BGRA
+	background xgraphics.BGRA
+	cursor     xgraphics.BGRA
+
+	selectionForeground xgraphics.BGRA
+	selectionBackground xgraphics.BGRA
+}
+
+// Built in themes, in the same format as theme files.
+var themes = map[string]string{
+	// the colors goterm has always used
+	"light": `
+foreground           #222222
+background           #ffffdd
+cursor               #222222
+selection_foreground #ffffdd
+selection_background #4a6fa5
+`,
+	"dark": `
+foreground           #c5c8c6
+background           #1d1f21
+cursor               #c5c8c6
+selection_foreground #1d1f21
+selection_background #81a2be
+color0               #1d1f21
+color1               #cc6666
+color2               #b5bd68
+color3               #f0c674
+color4               #81a2be
+color5               #b294bb
+color6               #8abeb7
+color7               #c5c8c6
+color8               #969896
+color9               #de935f
+color10              #b9ca4a
+color11              #e7c547
+color12              #7aa6da
+color13              #c397d8
+color14              #70c0b1
+color15              #eaeaea
+`,
+}
+
+func rgb(r, g, b uint8) xgraphics.BGRA {
+	return xgraphics.BGRA{B: b, G: g, R: r, A: 0xff}
+}
+
+// NewPalette returns goterm's light colors on top of xterm's default
+// 256 color table: the 16 ANSI colors, a 6x6x6 color cube and a 24
+// step grayscale ramp.
+func NewPalette() *Palette {
+	p := &Palette{
+		foreground:          rgb(0x22, 0x22, 0x22),
+		background:          rgb(0xff, 0xff, 0xdd),
+		cursor:              rgb(0x22, 0x22, 0x22),
+		selectionForeground: rgb(0xff, 0xff, 0xdd),
+		selectionBackground: rgb(0x4a, 0x6f, 0xa5),
+	}
+
+	ansi := []xgraphics.BGRA{
+		rgb(0x00, 0x00, 0x00), rgb(0xcd, 0x00, 0x00), rgb(0x00, 0xcd, 0x00), rgb(0xcd, 0xcd, 0x00),
+		rgb(0x00, 0x00, 0xee), rgb(0xcd, 0x00, 0xcd), rgb(0x00, 0xcd, 0xcd), rgb(0xe5, 0xe5, 0xe5),
+		rgb(0x7f, 0x7f, 0x7f), rgb(0xff, 0x00, 0x00), rgb(0x00, 0xff, 0x00), rgb(0xff, 0xff, 0x00),
+		rgb(0x5c, 0x5c, 0xff), rgb(0xff, 0x00, 0xff), rgb(0x00, 0xff, 0xff), rgb(0xff, 0xff, 0xff),
+	}
+	copy(p.colors[:], ansi)
+
+	levels := []uint8{0x00, 0x5f, 0x87, 0xaf, 0xd7, 0xff}
+	for i := 0; i < 216; i++ {
+		p.colors[16+i] = rgb(levels[i/36], levels[i/6%6], levels[i%6])
+	}
+	for i := 0; i < 24; i++ {
+		v := uint8(8 + i*10)
+		p.colors[232+i] = rgb(v, v, v)
+	}
+	return p
+}
+
+// LoadTheme returns the palette for a built in theme name, or reads
+// it from a theme file. A theme file holds one "key color" pair per
+// line, where key is foreground, background, cursor,
+// selection_foreground, selection_background or color0 to color255
+// and color is #rrggbb or #rgb. Lines starting with # are comments.
+// Anything the theme leaves out keeps xterm's default.
+func LoadTheme(name string) (*Palette, error) {
+	if theme, ok := themes[name]; ok {
+		return ParseTheme(strings.NewReader(theme))
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseTheme(f)
+}
+
+func ParseTheme(r io.Reader) (*Palette, error) {
+	p := NewPalette()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("theme line %d: expected a key and a color", n)
+		}
+		c, err := parseHexColor(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("theme line %d: %s", n, err)
+		}
+
+		switch key := fields[0]; key {
+		case "foreground":
+			p.foreground = c
+		case "background":
+			p.background = c
+		case "cursor":
+			p.cursor = c
+		case "selection_foreground":
+			p.selectionForeground = c
+		case "selection_background":
+			p.selectionBackground = c
+		default:
+			i, err := strconv.Atoi(strings.TrimPrefix(key, "color"))
+			if !strings.HasPrefix(key, "color") || err != nil || i < 0 || i > 255 {
+				return nil, fmt.Errorf("theme line %d: unknown key %q", n, key)
+			}
+			p.colors[i] = c
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseHexColor(s string) (xgraphics.BGRA, error) {
+	if !strings.HasPrefix(s, "#") {
+		return xgraphics.BGRA{}, fmt.Errorf("bad color %q", s)
+	}
+	hex := s[1:]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return xgraphics.BGRA{}, fmt.Errorf("bad color %q", s)
+	}
+	return rgb(uint8(v>>16), uint8(v>>8), uint8(v)), nil
+}
+
+// resolve turns a glyph color into something drawable, using def for
+// COLOR_DEFAULT.
+func (p *Palette) resolve(c Color, def xgraphics.BGRA) xgraphics.BGRA {
+	switch c & colorKindMask {
+	case colorIndexed:
+		return p.colors[c&0xff]
+	case colorRGB:
+		return rgb(uint8(c>>16), uint8(c>>8), uint8(c))
+	}
+	return def
+}
+
+// blend mixes a into b, weighting a by num/den.
+func blend(a, b xgraphics.BGRA, num, den int) xgraphics.BGRA {
+	mix := func(x, y uint8) uint8 {
+		return uint8((int(x)*num + int(y)*(den-num)) / den)
+	}
+	return xgraphics.BGRA{B: mix(a.B, b.B), G: mix(a.G, b.G), R: mix(a.R, b.R), A: 0xff}
+}
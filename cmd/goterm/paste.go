@@ -0,0 +1,38 @@
+package main
+
+import "strings"
+
+// Paste sends pasted text to the program. Newlines become carriage
+// returns, as if typed, and other control characters are dropped so
+// the text can't run commands or end a bracketed paste early.
+//
+// The write happens without term.mu held: a big paste into a program
+// that echoes it only finishes if the terminal keeps reading output.
+func (term *Terminal) Paste(text string) {
+	text = filterPaste(text)
+	if text == "" {
+		return
+	}
+	term.mu.Lock()
+	term.snapToBottom()
+	if term.bracketedPaste {
+		text = "\033[200~" + text + "\033[201~"
+	}
+	term.mu.Unlock()
+	term.pty.Write([]byte(text))
+}
+
+func filterPaste(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\r")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n':
+			return '\r'
+		case r == '\t' || r == '\r':
+			return r
+		case r < 0x20 || r >= 0x7f && r < 0xa0:
+			return -1
+		}
+		return r
+	}, text)
+}
@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+
+// DECRQM replies for the state of a mode
+const (
+	MODE_NOT_RECOGNIZED = iota
+	MODE_SET
+	MODE_RESET
+	MODE_PERMANENTLY_SET
+	MODE_PERMANENTLY_RESET
+)
+
+// reply queues a report for the program on the other end of the pty.
+// It is sent by sendReplies once term.mu is released: the write blocks
+// while the program isn't reading, and the X side needs the lock.
+func (term *Terminal) reply(format string, args ...interface{}) {
+	term.replies = append(term.replies, fmt.Sprintf(format, args...)...)
+}
+
+// sendReplies writes the replies taken from the queue.
+func (term *Terminal) sendReplies(replies []byte) {
+	if len(replies) == 0 {
+		return
+	}
+	if _, err := term.pty.Write(replies); err != nil && *debug {
+		fmt.Println("unable to reply:", err)
+	}
+}
+
+// deviceStatusReport handles DSR (CSI Ps n) and the DEC private form
+// (CSI ? Ps n).
+func (term *Terminal) deviceStatusReport(token Token) {
+	switch token.Param(0, 0) {
+	case 5:
+		// operating status: always fine
+		term.reply("\033[0n")
+	case 6:
+		// CPR, relative to the scroll region in origin mode
+		row, col := term.cursor.Y+1, term.cursor.X+1
+		if term.originMode {
+			row -= term.top
+		}
+		if token.Private == '?' {
+			// DECXCPR adds the page number
+			term.reply("\033[?%d;%d;1R", row, col)
+		} else {
+			term.reply("\033[%d;%dR", row, col)
+		}
+	}
+}
+
+// deviceAttributes handles DA1 (CSI c), DA2 (CSI > c) and DA3
+// (CSI = c).
+func (term *Terminal) deviceAttributes(token Token) {
+	if token.Param(0, 0) != 0 {
+		return
+	}
+	switch token.Private {
+	case 0:
+		// a VT220 with ANSI color
+		term.reply("\033[?62;22c")
+	case '>':
+		// VT220, firmware version 0, no keyboard options
+		term.reply("\033[>1;0;0c")
+	case '=':
+		// DECRPTUI with a zero unit id
+		term.reply("\033P!|00000000\033\\")
+	}
+}
+
+// requestMode handles DECRQM (CSI Ps $ p and CSI ? Ps $ p).
+func (term *Terminal) requestMode(token Token) {
+	mode := token.Param(0, 0)
+	if token.Private == '?' {
+		term.reply("\033[?%d;%d$y", mode, term.privateModeState(mode))
+	} else {
+		term.reply("\033[%d;%d$y", mode, term.modeState(mode))
+	}
+}
+
+func modeValue(on bool) int {
+	if on {
+		return MODE_SET
+	}
+	return MODE_RESET
+}
@@ -0,0 +1,52 @@
+package main
+
+// windowTitle is the title a new or fully reset terminal shows.
+const windowTitle = "goterm"
+
+// softReset handles DECSTR (CSI ! p). Unlike RIS it leaves the screen
+// contents and cursor position alone.
+func (term *Terminal) softReset() {
+	term.style = Style{}
+	term.charsets = [4]Charset{}
+	term.charsetGL = 0
+	term.singleShift = 0
+	term.originMode = false
+	term.autowrap = true
+	term.insertMode = false
+	term.appCursorKeys = false
+	term.appKeypad = false
+	term.wrapPending = false
+	term.top = 0
+	term.bot = term.height - 1
+	term.savedCursors = [2]SavedCursor{}
+}
+
+// fullReset handles RIS (ESC c), putting the terminal back the way it
+// was when it started.
+func (term *Terminal) fullReset() {
+	term.ui.EraseCursor(term)
+	term.softReset()
+	term.ClearSelection()
+
+	term.glyphs = term.newGrid()
+	term.altGlyphs = term.newGrid()
+	term.wrapped = make([]bool, term.height+1)
+	term.altWrapped = make([]bool, term.height+1)
+	term.altScreen = false
+	term.clearHistory()
+	term.joinNext = false
+	term.modifyOtherKeys = 0
+	term.mouseMode = MOUSE_NONE
+	term.mouseEncoding = MOUSE_ENCODING_DEFAULT
+	term.bracketedPaste = false
+	term.resetTabStops()
+
+	*term.palette = term.theme
+	term.ui.SetWindowTitle(windowTitle)
+
+	term.cursor.X = 0
+	term.cursor.Y = 0
+
+	term.ui.Clear(term)
+	term.dirtyRange(0, term.height-1)
+}
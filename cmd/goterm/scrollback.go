@@ -0,0 +1,106 @@
+package main
+
+// History is a ring of the rows that have scrolled off the top of the
+// primary screen, oldest first.
+type History struct {
+	rows    [][]*Glyph
+	wrapped []bool
+	start   int
+	count   int
+}
+
+func NewHistory(size int) History {
+	if size < 0 {
+		size = 0
+	}
+	return History{rows: make([][]*Glyph, size), wrapped: make([]bool, size)}
+}
+
+// push adds a row, dropping the oldest one when the ring is full.
+func (h *History) push(row []*Glyph, wrapped bool) {
+	size := len(h.rows)
+	if size == 0 {
+		return
+	}
+	i := (h.start + h.count) % size
+	if h.count == size {
+		h.start = (h.start + 1) % size
+	} else {
+		h.count++
+	}
+	h.rows[i] = row
+	h.wrapped[i] = wrapped
+}
+
+// row returns the ith row, counting from the oldest.
+func (h *History) row(i int) ([]*Glyph, bool) {
+	i = (h.start + i) % len(h.rows)
+	return h.rows[i], h.wrapped[i]
+}
+
+func (h *History) clear() {
+	for i := range h.rows {
+		h.rows[i] = nil
+	}
+	h.start, h.count = 0, 0
+}
+
+// saveLines keeps the top n rows of the primary screen before they
+// are scrolled away.
+func (term *Terminal) saveLines(n int) {
+	if term.altScreen {
+		return
+	}
+	for i := 0; i < n; i++ {
+		term.history.push(term.glyphs[i], term.wrapped[i])
+	}
+}
+
+// viewRow returns the row shown at screen row y, which is in the
+// history when the view is scrolled back.
+func (term *Terminal) viewRow(y int) []*Glyph {
+	row, _ := term.viewLine(y)
+	return row
+}
+
+// viewWrapped tells whether the row shown at y was soft wrapped.
+func (term *Terminal) viewWrapped(y int) bool {
+	_, wrapped := term.viewLine(y)
+	return wrapped
+}
+
+func (term *Terminal) viewLine(y int) ([]*Glyph, bool) {
+	if i := y - term.scrollOffset; i >= 0 {
+		return term.glyphs[i], term.wrapped[i]
+	}
+	return term.history.row(term.history.count + y - term.scrollOffset)
+}
+
+// ScrollView moves the view n rows back into the history, or forward
+// for negative n. The alternate screen has no history to look at.
+func (term *Terminal) ScrollView(n int) {
+	offset := clamp(term.scrollOffset+n, 0, term.history.count)
+	if term.altScreen {
+		offset = 0
+	}
+	if offset == term.scrollOffset {
+		return
+	}
+	// the selection is held in screen cells
+	term.ClearSelection()
+	term.scrollOffset = offset
+	term.dirtyRange(0, term.height-1)
+	needsDraw = true
+}
+
+// snapToBottom goes back to showing the screen, as new output and
+// typing do.
+func (term *Terminal) snapToBottom() {
+	term.ScrollView(-term.scrollOffset)
+}
+
+// clearHistory handles ED 3.
+func (term *Terminal) clearHistory() {
+	term.snapToBottom()
+	term.history.clear()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// how a selection grows as the mouse moves, set by the number of
+// clicks that started it
+const (
+	SELECT_CHAR = iota
+	SELECT_WORD
+	SELECT_LINE
+)
+
+// Selection is the text picked out with the mouse, as cells on the
+// screen. anchor is where the drag started and point where it is now.
+type Selection struct {
+	active bool
+	mode   int
+	rect   bool
+
+	anchorX, anchorY int
+	pointX, pointY   int
+}
+
+// StartSelection begins a selection at a cell.
+func (term *Terminal) StartSelection(x, y, mode int, rect bool) {
+	term.ClearSelection()
+	term.selection = Selection{
+		active:  true,
+		mode:    mode,
+		rect:    rect,
+		anchorX: x, anchorY: y,
+		pointX: x, pointY: y,
+	}
+	term.dirtySelection()
+}
+
+// ExtendSelection moves the end of the selection being dragged.
+func (term *Terminal) ExtendSelection(x, y int) {
+	if !term.selection.active {
+		return
+	}
+	term.dirtySelection()
+	term.selection.pointX, term.selection.pointY = x, y
+	term.dirtySelection()
+}
+
+// ClearSelection drops the highlight. The text stays with whoever
+// it was handed to.
+func (term *Terminal) ClearSelection() {
+	if !term.selection.active {
+		return
+	}
+	term.dirtySelection()
+	term.selection = Selection{}
+}
+
+// selectionChanged drops the selection if rows y1 to y2 are about to
+// change under it.
+func (term *Terminal) selectionChanged(y1, y2 int) {
+	if !term.selection.active {
+		return
+	}
+	_, top, _, bot := term.selectionBounds()
+	if y1 <= bot && y2 >= top {
+		term.ClearSelection()
+	}
+}
+
+// scrollSelection moves the selection along with rows top to bot as
+// they scroll up by n, or down for negative n. It is dropped if it
+// isn't wholly inside the region or scrolls out of it.
+func (term *Terminal) scrollSelection(top, bot, n int) {
+	s := &term.selection
+	if !s.active {
+		return
+	}
+	_, y1, _, y2 := term.selectionBounds()
+	if y2 < top || y1 > bot {
+		return
+	}
+	if y1 < top || y2 > bot || y1-n < top || y2-n > bot {
+		term.ClearSelection()
+		return
+	}
+	s.anchorY -= n
+	s.pointY -= n
+}
+
+func (term *Terminal) dirtySelection() {
+	if !term.selection.active {
+		return
+	}
+	_, top, _, bot := term.selectionBounds()
+	term.dirtyRange(top, bot)
+	needsDraw = true
+}
+
+// selectionBounds returns the selection's first and last cells in
+// reading order, grown to whole words or lines. For a rectangle they
+// are the corners instead.
+func (term *Terminal) selectionBounds() (x1, y1, x2, y2 int) {
+	s := term.selection
+	x1, y1, x2, y2 = s.anchorX, s.anchorY, s.pointX, s.pointY
+	if s.rect {
+		if x1 > x2 {
+			x1, x2 = x2, x1
+		}
+		if y1 > y2 {
+			y1, y2 = y2, y1
+		}
+		return
+	}
+	if y1 > y2 || y1 == y2 && x1 > x2 {
+		x1, y1, x2, y2 = x2, y2, x1, y1
+	}
+
+	switch s.mode {
+	case SELECT_WORD:
+		x1, y1 = term.wordEdge(x1, y1, -1)
+		x2, y2 = term.wordEdge(x2, y2, 1)
+	case SELECT_LINE:
+		// whole lines, following soft wraps
+		for y1 > 0 && term.viewWrapped(y1-1) {
+			y1--
+		}
+		for y2 < term.height-1 && term.viewWrapped(y2) {
+			y2++
+		}
+		x1, x2 = 0, term.width-1
+	}
+	return
+}
+
+// wordEdge walks from a cell in direction dir (-1 or 1) to the last
+// cell of the same class, going across soft wraps.
+func (term *Terminal) wordEdge(x, y, dir int) (int, int) {
+	class := term.charClass(x, y)
+	for {
+		nx, ny := x+dir, y
+		if nx < 0 {
+			if ny == 0 || !term.viewWrapped(ny-1) {
+				break
+			}
+			nx, ny = term.width-1, ny-1
+		} else if nx >= term.width {
+			if ny >= term.height-1 || !term.viewWrapped(ny) {
+				break
+			}
+			nx, ny = 0, ny+1
+		}
+		if term.charClass(nx, ny) != class {
+			break
+		}
+		x, y = nx, ny
+	}
+	return x, y
+}
+
+// wordChars are punctuation that counts as part of a word, so that
+// paths and URLs are picked up whole by a double click.
+const wordChars = "-_./~:@%+=?&#"
+
+// charClass groups cells for word selection: blanks, word characters
+// and everything else.
+func (term *Terminal) charClass(x, y int) int {
+	g := term.viewRow(y)[x]
+	if g != nil && g.spacer && x > 0 {
+		g = term.viewRow(y)[x-1]
+	}
+	if g == nil || g.char == ' ' || g.char == 0 {
+		return 0
+	}
+	if unicode.IsLetter(g.char) || unicode.IsDigit(g.char) || strings.ContainsRune(wordChars, g.char) {
+		return 1
+	}
+	return 2
+}
+
+// isSelected tells whether a cell is highlighted.
+func (term *Terminal) isSelected(x, y int) bool {
+	if !term.selection.active {
+		return false
+	}
+	x1, y1, x2, y2 := term.selectionBounds()
+	switch {
+	case y < y1 || y > y2:
+		return false
+	case term.selection.rect:
+		return x >= x1 && x <= x2
+	case y == y1 && x < x1:
+		return false
+	case y == y2 && x > x2:
+		return false
+	}
+	return true
+}
+
+// SelectedText returns the text under the selection. Rows are joined
+// with newlines unless they were soft wrapped, and blanks at the end
+// of each row are dropped.
+func (term *Terminal) SelectedText() string {
+	if !term.selection.active {
+		return ""
+	}
+	x1, y1, x2, y2 := term.selectionBounds()
+
+	var b strings.Builder
+	for y := y1; y <= y2; y++ {
+		from, to := 0, term.width-1
+		if term.selection.rect || y == y1 {
+			from = x1
+		}
+		if term.selection.rect || y == y2 {
+			to = x2
+		}
+
+		var row strings.Builder
+		for x := from; x <= to; x++ {
+			g := term.viewRow(y)[x]
+			switch {
+			case g == nil:
+				row.WriteByte(' ')
+			case g.spacer:
+			default:
+				row.WriteString(g.String())
+			}
+		}
+		line := row.String()
+		softWrap := !term.selection.rect && term.viewWrapped(y) && to == term.width-1
+		if !softWrap {
+			line = strings.TrimRight(line, " ")
+		}
+		b.WriteString(line)
+		if y < y2 && !softWrap {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,220 @@
+package main
+
+// Attr is a bit set of the SGR attributes a glyph is drawn with.
+type Attr uint16
+
+const (
+	ATTR_BOLD Attr = 1 << iota
+	ATTR_DIM
+	ATTR_ITALIC
+	ATTR_BLINK
+	ATTR_RAPID_BLINK
+	ATTR_REVERSE
+	ATTR_INVISIBLE
+	ATTR_STRIKE
+	ATTR_OVERLINE
+	// set by DECSCA rather than SGR, so SGR 0 leaves it alone
+	ATTR_PROTECTED
+)
+
+// Underline is the style of line drawn beneath a glyph.
+type Underline uint8
+
+const (
+	UNDERLINE_NONE Underline = iota
+	UNDERLINE_SINGLE
+	UNDERLINE_DOUBLE
+	UNDERLINE_CURLY
+	UNDERLINE_DOTTED
+	UNDERLINE_DASHED
+)
+
+// Color is either the default color, an index into the 256 color
+// palette or a direct RGB value. The kind lives in the top byte.
+type Color uint32
+
+const (
+	COLOR_DEFAULT Color = 0
+	colorIndexed  Color = 1 << 24
+	colorRGB      Color = 2 << 24
+	colorKindMask Color = 0xff << 24
+)
+
+// IndexedColor and RGBColor take values from 0 to 255; SGR checks
+// them with inByteRange first.
+func IndexedColor(n int) Color {
+	return colorIndexed | Color(n)
+}
+
+func RGBColor(r, g, b int) Color {
+	return colorRGB | Color(r)<<16 | Color(g)<<8 | Color(b)
+}
+
+func inByteRange(values ...int) bool {
+	for _, v := range values {
+		if v < 0 || v > 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// Style is the pen that printed text is drawn with.
+type Style struct {
+	fg        Color
+	bg        Color
+	ulColor   Color
+	attr      Attr
+	underline Underline
+}
+
+// fontName picks the face SetFont should load for the style.
+func (s Style) fontName() string {
+	bold := s.attr&ATTR_BOLD != 0
+	italic := s.attr&ATTR_ITALIC != 0
+	switch {
+	case bold && italic:
+		return "bold-italic"
+	case bold:
+		return "bold"
+	case italic:
+		return "italic"
+	}
+	return "regular"
+}
+
+// setGraphicsRendition handles SGR (CSI m).
+func (term *Terminal) setGraphicsRendition(token Token) {
+	params := token.Params
+	if len(params) == 0 {
+		params = []int{0}
+	}
+
+	s := &term.style
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch {
+		case p == 0:
+			*s = Style{attr: s.attr & ATTR_PROTECTED}
+		case p == 1:
+			s.attr |= ATTR_BOLD
+		case p == 2:
+			s.attr |= ATTR_DIM
+		case p == 3:
+			s.attr |= ATTR_ITALIC
+		case p == 4:
+			s.underline = UNDERLINE_SINGLE
+			if sub := token.Sub(i); len(sub) > 0 && sub[0] <= int(UNDERLINE_DASHED) {
+				s.underline = Underline(sub[0])
+			}
+		case p == 5:
+			s.attr |= ATTR_BLINK
+		case p == 6:
+			s.attr |= ATTR_RAPID_BLINK
+		case p == 7:
+			s.attr |= ATTR_REVERSE
+		case p == 8:
+			s.attr |= ATTR_INVISIBLE
+		case p == 9:
+			s.attr |= ATTR_STRIKE
+		case p == 21:
+			// ECMA-48 and xterm treat this as double underline
+			// rather than "bold off"
+			s.underline = UNDERLINE_DOUBLE
+		case p == 22:
+			s.attr &^= ATTR_BOLD | ATTR_DIM
+		case p == 23:
+			s.attr &^= ATTR_ITALIC
+		case p == 24:
+			s.underline = UNDERLINE_NONE
+		case p == 25:
+			s.attr &^= ATTR_BLINK | ATTR_RAPID_BLINK
+		case p == 27:
+			s.attr &^= ATTR_REVERSE
+		case p == 28:
+			s.attr &^= ATTR_INVISIBLE
+		case p == 29:
+			s.attr &^= ATTR_STRIKE
+		case p >= 30 && p <= 37:
+			s.fg = IndexedColor(p - 30)
+		case p == 38:
+			c, n, ok := extendedColor(token, i)
+			if ok {
+				s.fg = c
+			}
+			i += n
+		case p == 39:
+			s.fg = COLOR_DEFAULT
+		case p >= 40 && p <= 47:
+			s.bg = IndexedColor(p - 40)
+		case p == 48:
+			c, n, ok := extendedColor(token, i)
+			if ok {
+				s.bg = c
+			}
+			i += n
+		case p == 49:
+			s.bg = COLOR_DEFAULT
+		case p == 53:
+			s.attr |= ATTR_OVERLINE
+		case p == 55:
+			s.attr &^= ATTR_OVERLINE
+		case p == 58:
+			c, n, ok := extendedColor(token, i)
+			if ok {
+				s.ulColor = c
+			}
+			i += n
+		case p == 59:
+			s.ulColor = COLOR_DEFAULT
+		case p >= 90 && p <= 97:
+			s.fg = IndexedColor(p - 90 + 8)
+		case p >= 100 && p <= 107:
+			s.bg = IndexedColor(p - 100 + 8)
+		}
+	}
+}
+
+// extendedColor parses the color following a 38, 48 or 58 at
+// position i. Both the colon form (38:2::r:g:b, 38:5:n) and the
+// semicolon form (38;2;r;g;b, 38;5;n) are accepted. It returns the
+// color, how many of the following parameters it used up, and
+// whether the color was well formed. Like xterm, values past 255 make
+// it malformed rather than wrapping around.
+func extendedColor(token Token, i int) (Color, int, bool) {
+	if sub := token.Sub(i); len(sub) > 0 {
+		switch sub[0] {
+		case 5:
+			if len(sub) > 1 && inByteRange(sub[1]) {
+				return IndexedColor(sub[1]), 0, true
+			}
+		case 2:
+			rgb := sub[1:]
+			// an optional color space id comes before r:g:b
+			if len(rgb) > 3 {
+				rgb = rgb[1:]
+			}
+			if len(rgb) == 3 && inByteRange(rgb...) {
+				return RGBColor(rgb[0], rgb[1], rgb[2]), 0, true
+			}
+		}
+		return COLOR_DEFAULT, 0, false
+	}
+
+	rest := token.Params[i+1:]
+	if len(rest) == 0 {
+		return COLOR_DEFAULT, 0, false
+	}
+	switch rest[0] {
+	case 5:
+		if len(rest) > 1 {
+			return IndexedColor(rest[1]), 2, inByteRange(rest[1])
+		}
+	case 2:
+		if len(rest) > 3 {
+			return RGBColor(rest[1], rest[2], rest[3]), 4, inByteRange(rest[1:4]...)
+		}
+	}
+	// malformed; skip whatever is left
+	return COLOR_DEFAULT, len(rest), false
+}
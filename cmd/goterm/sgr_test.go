@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestExtendedColor(t *testing.T) {
+	red := IndexedColor(1)
+	tests := []struct {
+		name      string
+		params    []int
+		subParams [][]int
+		want      Color
+	}{
+		{"indexed", []int{38, 5, 200}, nil, IndexedColor(200)},
+		{"indexed colon", []int{38}, [][]int{{5, 200}}, IndexedColor(200)},
+		{"indexed 255", []int{38, 5, 255}, nil, IndexedColor(255)},
+		{"indexed out of range", []int{38, 5, 300}, nil, red},
+		{"indexed colon out of range", []int{38}, [][]int{{5, 300}}, red},
+		{"rgb", []int{38, 2, 1, 2, 3}, nil, RGBColor(1, 2, 3)},
+		{"rgb colon", []int{38}, [][]int{{2, 0, 1, 2, 3}}, RGBColor(1, 2, 3)},
+		{"rgb out of range", []int{38, 2, 1, 256, 3}, nil, red},
+		{"rgb colon out of range", []int{38}, [][]int{{2, 1, 2, 999}}, red},
+	}
+	for _, tt := range tests {
+		term := &Terminal{style: Style{fg: red}}
+		term.setGraphicsRendition(Token{Params: tt.params, SubParams: tt.subParams})
+		if term.style.fg != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, term.style.fg, tt.want)
+		}
+	}
+
+	// a rejected color still uses up its parameters
+	term := &Terminal{}
+	term.setGraphicsRendition(Token{Params: []int{38, 5, 300, 1}})
+	if term.style.fg != COLOR_DEFAULT || term.style.attr != ATTR_BOLD {
+		t.Errorf("after 38;5;300;1: got fg %#x attr %#x, want default and bold", term.style.fg, term.style.attr)
+	}
+}
@@ -2,40 +2,60 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sheik/xgbutil/xgraphics"
 )
 
 var (
-	// The background color of the canvas.
-	bg = xgraphics.BGRA{B: 0xdd, G: 0xff, R: 0xff, A: 0xff}
-
-	// The path to the font used to draw text.
-	fontPath     = "/usr/share/fonts/truetype/firacode/FiraCode-Regular.ttf"
-	fontPathBold = "/usr/share/fonts/truetype/firacode/FiraCode-SemiBold.ttf"
-
-	// The color of the text.
-	fg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
+	// The paths to the fonts used to draw text. FiraCode has no
+	// italic faces, so italic text falls back to the upright ones
+	// unless these point at something that exists.
+	fontPath           = "/usr/share/fonts/truetype/firacode/FiraCode-Regular.ttf"
+	fontPathBold       = "/usr/share/fonts/truetype/firacode/FiraCode-SemiBold.ttf"
+	fontPathItalic     = ""
+	fontPathBoldItalic = ""
 
 	// The size of the text.
 	size = 13.0
+
+	// How often blinking text is toggled.
+	blinkInterval = 500 * time.Millisecond
 )
 
 type Glyph struct {
-	X       int
-	Y       int
-	fg      xgraphics.BGRA
-	bg      xgraphics.BGRA
-	literal []byte
+	X int
+	Y int
+	Style
+	char rune
+	// combining holds marks and joined code points that belong to
+	// the same grapheme cluster as char
+	combining []rune
+	// wide glyphs take two cells; the right hand one holds a spacer
+	wide   bool
+	spacer bool
+}
+
+// String returns the whole grapheme cluster held by the glyph.
+func (g *Glyph) String() string {
+	if g.spacer {
+		return ""
+	}
+	if len(g.combining) == 0 {
+		return string(g.char)
+	}
+	return string(g.char) + string(g.combining)
 }
 
 type Terminal struct {
+	// held while handling output and drawing, and by the UI's event
+	// handlers when they touch the terminal
+	mu sync.Mutex
+
 	cursor Cursor
 	width  int
 	height int
@@ -45,11 +65,89 @@ type Terminal struct {
 	glyphs    [][]*Glyph
 	dirtyRows map[int]bool
 
+	// wrapped[y] is set when row y was soft wrapped onto the next
+	// row, so that it continues the same logical line
+	wrapped []bool
+
+	// the screen not being shown; glyphs always holds the active one
+	altGlyphs  [][]*Glyph
+	altWrapped []bool
+	altScreen  bool
+
+	// rows scrolled off the primary screen, and how many of them
+	// the view is scrolled back by
+	history      History
+	scrollOffset int
+
+	// DECSC state, kept separately for the primary and alternate
+	// screens and indexed by altScreen
+	savedCursors [2]SavedCursor
+
 	ui UI
 
 	// top and bottom pointers (cursor Y values)
 	top int
 	bot int
+
+	// the last character printed was a zero width joiner, so the
+	// next one belongs to the same cell
+	joinNext bool
+
+	// the pen set by SGR
+	style Style
+
+	// G0-G3, the one invoked into GL, and a pending SS2 or SS3.
+	// GR isn't used since 8-bit input is taken as UTF-8.
+	charsets    [4]Charset
+	charsetGL   int
+	singleShift int
+
+	// tabStops[x] is set when column x has a tab stop
+	tabStops []bool
+
+	// modes
+	originMode bool
+	autowrap   bool
+	insertMode bool
+
+	// DECCKM and DECKPAM
+	appCursorKeys bool
+	appKeypad     bool
+
+	// xterm's modifyOtherKeys level
+	modifyOtherKeys int
+
+	// mouse tracking and how reports are encoded, and the cell of
+	// the last report so motion is only sent between cells
+	mouseMode     int
+	mouseEncoding int
+	lastMouseX    int
+	lastMouseY    int
+
+	// pastes are wrapped in ESC[200~ and ESC[201~
+	bracketedPaste bool
+
+	// reports waiting to be written to the pty
+	replies []byte
+
+	// a glyph was written to the last column; the cursor moves to
+	// the next row when the next one arrives
+	wrapPending bool
+
+	palette *Palette
+	// the palette as it was loaded, for RIS to go back to
+	theme Palette
+
+	// text picked out with the mouse
+	selection Selection
+
+	// text the input method is composing, shown at the cursor
+	preedit      []rune
+	preeditCaret int
+
+	// blinking text is currently shown
+	blinkOn   bool
+	lastBlink time.Time
 }
 
 type Cursor struct {
@@ -59,11 +157,22 @@ type Cursor struct {
 	height int
 }
 
+// SavedCursor is the state remembered by DECSC, CSI s and mode 1049.
+type SavedCursor struct {
+	X           int
+	Y           int
+	style       Style
+	originMode  bool
+	wrapPending bool
+	charsets    [4]Charset
+	charsetGL   int
+}
+
 var redraw = false
 var needsDraw = true
 
-func NewTerminal(inPty io.ReadWriter, ui UI, width, height int) (term *Terminal, err error) {
-	term = &Terminal{width: width, height: height, top: 0, bot: height - 1, pty: inPty}
+func NewTerminal(inPty io.ReadWriter, ui UI, palette *Palette, width, height int) (term *Terminal, err error) {
+	term = &Terminal{width: width, height: height, top: 0, bot: height - 1, pty: inPty, palette: palette, autowrap: true}
 
 	term.ui = ui
 
@@ -76,10 +185,13 @@ func NewTerminal(inPty io.ReadWriter, ui UI, width, height int) (term *Terminal,
 
 	term.dirtyRows = make(map[int]bool)
 
-	term.glyphs = make([][]*Glyph, term.height+1)
-	for i := range term.glyphs {
-		term.glyphs[i] = make([]*Glyph, term.width+1)
-	}
+	term.glyphs = term.newGrid()
+	term.altGlyphs = term.newGrid()
+	term.wrapped = make([]bool, term.height+1)
+	term.altWrapped = make([]bool, term.height+1)
+	term.history = NewHistory(*scrollback)
+	term.resetTabStops()
+	term.theme = *palette
 
 	term.ui.CreateWindow(term)
 
@@ -94,377 +206,660 @@ func NewTerminal(inPty io.ReadWriter, ui UI, width, height int) (term *Terminal,
 			var token Token
 			select {
 			case <-time.After(time.Duration(i) * time.Microsecond):
+				term.mu.Lock()
+				term.blink()
 				if needsDraw || redraw {
 					term.Draw()
 					term.ui.UpdateDisplay(term)
 				}
+				term.mu.Unlock()
 				continue
 			case token = <-tokenChan:
-				needsDraw = true
 			}
 
 			if *debug {
-				if token.Type == TEXT {
-					fmt.Printf("%s %v \"%s\"\n", token.Type, []byte(token.Literal), token.Literal)
-				} else {
-					fmt.Printf("%s %v \"%s\"\n", token.Type, []byte(token.Literal), token.Literal[1:])
-				}
+				fmt.Println(token)
 			}
 
+			term.mu.Lock()
+			// the draw flags are shared with the X side
+			needsDraw = true
+			term.snapToBottom()
 			switch token.Type {
-			case BAR:
-				continue
-			case RESET_INITIAL_STATE:
-				// reset title
-				term.ui.SetWindowTitle("none")
-				// reset cursor
-				term.cursor.X = 0
-				term.cursor.Y = 0
-				term.top = 0
-				term.bot = term.height - 1
-				// reset cols
-			case CR:
-				term.ui.EraseCursor(term)
-				term.cursor.X = 0
-			case LF:
-				term.ui.EraseCursor(term)
-				term.IncreaseY()
-				continue
-			case BACKSPACE:
-				term.ui.EraseCursor(term)
-				term.cursor.X -= 1
-				if term.cursor.X < 0 {
-					term.cursor.X = 0
-				}
-				continue
-			case INSERT_LINE:
-				term.ScrollUp()
-			case MOVE_TO_COL:
-				n := 1
-				if len(token.Literal) > 3 {
-					n, err = strconv.Atoi(string(token.Literal[2 : len(token.Literal)-1]))
-					if err != nil {
-						fmt.Println("could not determine n for col move")
-					}
-				}
-				term.cursor.X = n - 1
-			case CLEAR_LINE:
-				n := 0
-				if len(token.Literal) > 3 {
-					n, err = strconv.Atoi(string(token.Literal[2 : len(token.Literal)-1]))
-					if err != nil {
-						fmt.Println("unable to determine n for delete chars")
-						continue
-					}
+			case TEXT:
+				term.handleText(token)
+			case CONTROL:
+				term.handleControl(token)
+			case ESCAPE:
+				term.handleEscape(token)
+			case CSI:
+				term.handleCSI(token)
+			case OSC:
+				term.handleOSC(token)
+			case END_OF_STREAM:
+				if token.Err != nil && *debug {
+					fmt.Println("reader error:", token.Err)
 				}
+				term.Draw()
+				term.mu.Unlock()
+				term.ui.Close(term)
+				return
+			}
+			replies := term.replies
+			term.replies = nil
+			term.mu.Unlock()
+			term.sendReplies(replies)
+		}
+	}()
+	return term, nil
+}
 
-				switch n {
-				case 0:
-					term.ClearRegion(term.cursor.X, term.cursor.Y, term.width-1, term.cursor.Y)
-				case 1:
-					term.ClearRegion(0, term.cursor.Y, term.cursor.X, term.cursor.Y)
-				case 2:
-					term.ClearRegion(0, term.cursor.Y, term.width-1, term.cursor.Y)
-				}
+func (term *Terminal) handleText(token Token) {
+	for _, c := range token.Runes {
+		term.putChar(c)
+	}
+}
 
-				redraw = true
-				term.dirtyRows[term.cursor.Y] = true
-			case COLOR_CODE:
-
-				// cursor <n> forward
-				if token.Literal[len(token.Literal)-1] == 'C' {
-					n := 1
-					if len(token.Literal) > 3 {
-						n, err = strconv.Atoi(string(token.Literal[2 : len(token.Literal)-1]))
-						if err != nil {
-							fmt.Println("could not determine n for cursor move")
-						}
-					}
-					term.cursor.X += n
-					if term.cursor.X >= term.width {
-						term.cursor.X = term.width - 1
-					}
-				}
+func (term *Terminal) putChar(c rune) {
+	c = term.translateChar(c)
+	w := runeWidth(c)
 
-				if token.Literal[len(token.Literal)-1] == '@' {
-					n, err := strconv.Atoi(string(token.Literal[2 : len(token.Literal)-1]))
-					if err != nil {
-						fmt.Println("Could not convert to number:", token.Literal[1:])
-					}
-
-					// Move characters after the cursor to the right
-					for i := term.width - 1; i > term.cursor.X; i-- {
-						if (i - n) < 0 {
-							break
-						}
-						term.glyphs[term.cursor.Y][i] = term.glyphs[term.cursor.Y][i-n]
-					}
-
-					// Fill n characters after cursor with blanks
-					for i := 0; i < n; i++ {
-						term.ui.DrawRect(term,
-							false,
-							bg,
-							term.cursor.X*term.cursor.width+i*term.cursor.width,
-							term.cursor.Y*term.cursor.height,
-							term.cursor.X*term.cursor.width+i*term.cursor.width+term.cursor.width,
-							term.cursor.Y*term.cursor.height+term.cursor.height,
-						)
-					}
-
-					redraw = true
-					term.dirtyRows[term.cursor.Y] = true
-				}
+	if prev := term.previousGlyph(); prev != nil {
+		joins := w == 0 || term.joinNext
+		// a pair of regional indicators makes up a flag
+		if isRegionalIndicator(c) && isRegionalIndicator(prev.char) && len(prev.combining) == 0 {
+			joins = true
+		}
+		if joins {
+			prev.combining = append(prev.combining, c)
+			term.joinNext = c == zeroWidthJoiner
+			term.dirtyRows[term.cursor.Y] = true
+			redraw = true
+			return
+		}
+	}
+	term.joinNext = false
+	if w == 0 {
+		// nothing to attach to
+		return
+	}
+	if w > term.width {
+		// a wide glyph can't fit on a one column screen
+		w = 1
+	}
 
-				if token.Literal[len(token.Literal)-1] == 'r' {
-					// TODO set scroll region
-					top, err := strconv.Atoi(strings.Split(string(token.Literal[2:len(token.Literal)-1]), ";")[0])
-					if err != nil {
-						fmt.Println("could not convert top:", string(token.Literal[1:]))
-						top = 0
-					}
-					bot, err := strconv.Atoi(strings.Split(string(token.Literal[2:len(token.Literal)-1]), ";")[1])
-					if err != nil {
-						fmt.Println("could not convert bot")
-						bot = 0
-					}
-					term.top = top - 1
-					term.bot = bot - 1
-					term.cursor.Y = term.top
-				}
+	if term.wrapPending {
+		term.wrapLine()
+	}
+	if term.cursor.X+w > term.width {
+		// a wide glyph that doesn't fit in the last column
+		if term.autowrap {
+			term.wrapLine()
+		} else {
+			term.cursor.X = term.width - w
+		}
+	}
 
-				/*
-					if token.Literal[len(token.Literal)-1] == 'h' {
-						// TODO implement set term mode
-					}
-					if token.Literal[len(token.Literal)-1] == 'l' {
-						// TODO implement unset term mode
-					}
-				*/
-				// color codes
-				if token.Literal[len(token.Literal)-1] == 'm' {
-					args := strings.Split(string(token.Literal[2:len(token.Literal)-1]), ";")
-
-					if len(args) > 0 {
-						switch args[0] {
-						case "":
-							term.ui.SetFont("regular")
-							fg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
-							bg = xgraphics.BGRA{B: 0xdd, G: 0xff, R: 0xff, A: 0xff}
-						case "0":
-							term.ui.SetFont("regular")
-							fg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
-							bg = xgraphics.BGRA{B: 0xdd, G: 0xff, R: 0xff, A: 0xff}
-						case "00":
-							term.ui.SetFont("regular")
-							fg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
-							bg = xgraphics.BGRA{B: 0xdd, G: 0xff, R: 0xff, A: 0xff}
-						case "1":
-							term.ui.SetFont("bold")
-						case "01":
-							term.ui.SetFont("bold")
-						case "7":
-							fg = xgraphics.BGRA{B: 0xdd, G: 0xff, R: 0xff, A: 0xff}
-							bg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
-						case "27":
-							fg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
-							bg = xgraphics.BGRA{B: 0xdd, G: 0xff, R: 0xff, A: 0xff}
-						case "32":
-							fg = xgraphics.BGRA{B: 0x00, G: 0xff, R: 0x00, A: 0xff}
-						case "34":
-							fg = xgraphics.BGRA{B: 0xff, G: 0x00, R: 0x00, A: 0xff}
-						case "39":
-							fg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
-						case "42":
-							bg = xgraphics.BGRA{B: 0x00, G: 0xff, R: 0x00, A: 0xff}
-						}
-					}
-					if len(args) > 1 {
-						switch args[1] {
-						case "32":
-							fg = xgraphics.BGRA{B: 0x00, G: 0xff, R: 0x00, A: 0xff}
-						case "34":
-							fg = xgraphics.BGRA{B: 0xff, G: 0x00, R: 0x00, A: 0xff}
-						case "39":
-							fg = xgraphics.BGRA{B: 0x22, G: 0x22, R: 0x22, A: 0xff}
-						case "42":
-							bg = xgraphics.BGRA{B: 0x00, G: 0xff, R: 0x00, A: 0xff}
-						}
-
-					}
-					if len(args) > 2 {
-						fmt.Println("SET BACKGROUND:", args[2])
-						switch args[2] {
-						case "32":
-							fg = xgraphics.BGRA{B: 0x00, G: 0xff, R: 0x00, A: 0xff}
-						case "34":
-							fg = xgraphics.BGRA{B: 0xff, G: 0x00, R: 0x00, A: 0xff}
-						case "39":
-							fg = xgraphics.BGRA{B: 0xdd, G: 0xff, R: 0xff, A: 0xff}
-						}
-					}
-				}
+	x, y := term.cursor.X, term.cursor.Y
+	term.selectionChanged(y, y)
+	if term.insertMode {
+		// IRM pushes what is already there to the right
+		term.insertChars(w)
+	}
+	term.clearWide(x, y)
+	term.glyphs[y][x] = &Glyph{
+		X:     x,
+		Y:     y,
+		Style: term.style,
+		char:  c,
+		wide:  w == 2,
+	}
+	if w == 2 {
+		term.clearWide(x+1, y)
+		term.glyphs[y][x+1] = &Glyph{X: x + 1, Y: y, Style: term.style, spacer: true}
+	}
 
-				continue
-			case OSC:
-				parts := strings.Split(string(token.Literal[2:len(token.Literal)-1]), ";")
-				switch parts[0] {
-				case "0":
-					term.ui.SetWindowTitle(parts[1])
-				case "10":
-					if parts[1] == "?" {
-						// SEND CODES
-					}
-				case "11":
-				case "12":
-				}
-				continue
-			case CURSOR_POSITION_REQUEST:
-				//				position := fmt.Sprintf("\033%d;%dR", term.cursor.Y, term.cursor.X)
-				//				term.pty.WriteString(position)
-			case RESET_CURSOR:
-				term.ui.EraseCursor(term)
-				x := 1
-				y := 1
-				if bytes.Contains(token.Literal, []byte(";")) {
-					y, err = strconv.Atoi(strings.Split(string(token.Literal[2:len(token.Literal)-1]), ";")[0])
-					if err != nil {
-						fmt.Println("unable to convert y coordinate", []byte(token.Literal), string(token.Literal[1:]))
-						continue
-					}
-					x, err = strconv.Atoi(strings.Split(string(token.Literal[2:len(token.Literal)-1]), ";")[1])
-					if err != nil {
-						fmt.Println("unable to convert x coordinate")
-						continue
-					}
-				}
-				if x < 0 {
-					x = 0
-				}
-				if y < 0 {
-					y = 0
-				}
+	term.drawCell(x, y)
 
-				term.cursor.X = x - 1
-				term.cursor.Y = term.top + y - 1
-			case DELETE_LINES:
-				term.ScrollUp()
-			case DELETE_CHARS:
-				// TODO this function needs to be rewritten!
-				n := 1
-				n, err := strconv.Atoi(string(token.Literal[2 : len(token.Literal)-1]))
-				if err != nil {
-					fmt.Println("unable to determine n for delete chars")
-					continue
-				}
-				for i := term.cursor.X; i < term.width-1; i++ {
-					if i+n > term.width-1 {
-						term.glyphs[term.cursor.Y][i] = nil
-						continue
-					}
-					term.glyphs[term.cursor.Y][i] = term.glyphs[term.cursor.Y][i+n]
-				}
-				for i := term.width - n; i < term.width; i++ {
-					term.glyphs[term.cursor.Y][i] = nil
-				}
-				redraw = true
-				term.dirtyRows[term.cursor.Y] = true
-			case CURSOR_ROW:
-				y := 1
-				y, err := strconv.Atoi(string(token.Literal[2 : len(token.Literal)-1]))
-				if err != nil {
-					fmt.Println("unable to convert y coordinate for CURSOR_ROW")
-				}
-				y -= 1
-				if y < 0 {
-					term.cursor.Y = 0
-					term.ScrollUp()
-				} else {
-					term.cursor.Y = y
-				}
-			case TEXT:
-				if token.Literal[0] == '\t' {
-					token.Literal = []byte("    ")
-				}
+	// the cursor stays on the last column until the next glyph
+	// arrives, so that filling the line doesn't scroll early
+	if x+w >= term.width {
+		term.cursor.X = term.width - 1
+		term.wrapPending = term.autowrap
+	} else {
+		term.cursor.X = x + w
+	}
+}
 
-				if token.Literal[0] > 128 || token.Literal[0] == 0x07 {
-					continue
-				}
+// wrapLine continues output on the next row and remembers that the
+// row it left was soft wrapped.
+func (term *Terminal) wrapLine() {
+	term.wrapped[term.cursor.Y] = true
+	term.Index()
+	term.cursor.X = 0
+}
 
-				// TODO is wrapping a term mode?
-				if term.cursor.X >= term.width {
-					term.cursor.X = 0
-					term.IncreaseY()
-					continue
-				}
+// previousGlyph returns the glyph just before the cursor, which is
+// where combining characters attach.
+func (term *Terminal) previousGlyph() *Glyph {
+	x, y := term.cursor.X-1, term.cursor.Y
+	if term.wrapPending {
+		// the last glyph written is under the cursor
+		x = term.cursor.X
+	}
+	if x < 0 || y >= term.height {
+		return nil
+	}
+	g := term.glyphs[y][x]
+	if g != nil && g.spacer && x > 0 {
+		g = term.glyphs[y][x-1]
+	}
+	if g == nil || g.spacer {
+		return nil
+	}
+	return g
+}
 
-				if term.cursor.Y >= term.height {
-					term.cursor.Y = term.height - 1
-				}
+// clearWide blanks the other half of a wide glyph at (x, y) that is
+// about to be partially overwritten.
+func (term *Terminal) clearWide(x, y int) {
+	g := term.glyphs[y][x]
+	if g == nil {
+		return
+	}
+	if g.spacer && x > 0 {
+		term.glyphs[y][x-1] = nil
+		term.dirtyRows[y] = true
+		redraw = true
+	}
+	if g.wide && x+1 < term.width {
+		term.glyphs[y][x+1] = nil
+		term.dirtyRows[y] = true
+		redraw = true
+	}
+}
 
-				if term.cursor.X >= term.width {
-					term.cursor.X = term.width - 1
-				}
+// fixWide blanks halves of wide glyphs in row y that have been
+// separated from their other half by shifting cells around.
+func (term *Terminal) fixWide(y int) {
+	row := term.glyphs[y]
+	for x := 0; x < term.width; x++ {
+		g := row[x]
+		if g == nil {
+			continue
+		}
+		if g.spacer && (x == 0 || row[x-1] == nil || !row[x-1].wide) {
+			row[x] = nil
+		}
+		if g.wide && (x+1 >= term.width || row[x+1] == nil || !row[x+1].spacer) {
+			row[x] = nil
+		}
+	}
+}
 
-				term.glyphs[term.cursor.Y][term.cursor.X] = &Glyph{
-					X:       term.cursor.X,
-					Y:       term.cursor.Y,
-					fg:      fg,
-					bg:      bg,
-					literal: token.Literal,
-				}
+func (term *Terminal) handleControl(token Token) {
+	switch token.Final {
+	case '\r':
+		term.moveCursor(0, term.cursor.Y)
+	case '\n', '\v', '\f':
+		term.Index()
+	case '\b':
+		term.moveCursor(term.cursor.X-1, term.cursor.Y)
+	case 0x0e:
+		// SO
+		term.charsetGL = 1
+	case 0x0f:
+		// SI
+		term.charsetGL = 0
+	case '\t':
+		term.tabForward(1)
+	}
+}
 
-				term.ui.WriteText(term, term.cursor.X, term.cursor.Y, fg, bg, string(token.Literal))
+func (term *Terminal) handleEscape(token Token) {
+	if len(token.Intermediates) > 0 {
+		switch token.Intermediates[0] {
+		case '(', ')', '*', '+', '-', '.', '/':
+			term.designateCharset(token)
+		}
+		return
+	}
+	switch token.Final {
+	case 'n':
+		// LS2
+		term.charsetGL = 2
+	case 'o':
+		// LS3
+		term.charsetGL = 3
+	case 'N':
+		// SS2
+		term.singleShift = 2
+	case 'O':
+		// SS3
+		term.singleShift = 3
+	case 'c':
+		term.fullReset()
+	case '=':
+		// DECKPAM
+		term.appKeypad = true
+	case '>':
+		// DECKPNM
+		term.appKeypad = false
+	case '7':
+		term.saveCursor()
+	case '8':
+		term.restoreCursor()
+	case 'H':
+		// HTS
+		term.tabStops[term.cursor.X] = true
+	case 'D':
+		term.Index()
+	case 'E':
+		term.Index()
+		term.moveCursor(0, term.cursor.Y)
+	case 'M':
+		term.ReverseIndex()
+	}
+}
 
-				term.cursor.X += len(token.Literal)
-			case CLEAR:
-				term.ui.Clear(term)
-				for i := 0; i < term.height; i++ {
-					for j := 0; j < term.width; j++ {
-						term.glyphs[i][j] = nil
-					}
-				}
+func (term *Terminal) handleCSI(token Token) {
+	if len(token.Intermediates) > 0 {
+		switch string(token.Intermediates) + string(token.Final) {
+		case "$p":
+			term.requestMode(token)
+		case "!p":
+			term.softReset()
+		case "\"q":
+			// DECSCA
+			if token.Param(0, 0) == 1 {
+				term.style.attr |= ATTR_PROTECTED
+			} else {
+				term.style.attr &^= ATTR_PROTECTED
+			}
+		}
+		return
+	}
+	if token.Private == '?' {
+		switch token.Final {
+		case 'J':
+			term.eraseDisplay(token.Param(0, 0), true)
+		case 'K':
+			term.eraseLine(token.Param(0, 0), true)
+		case 'h':
+			term.setPrivateModes(token, true)
+		case 'l':
+			term.setPrivateModes(token, false)
+		case 'n':
+			term.deviceStatusReport(token)
+		}
+		return
+	}
+	if token.Private != 0 {
+		switch {
+		case token.Final == 'c':
+			term.deviceAttributes(token)
+		case token.Private == '>' && (token.Final == 'm' || token.Final == 'n'):
+			term.setKeyModifierOptions(token)
+		}
+		return
+	}
 
+	switch token.Final {
+	case 'c':
+		term.deviceAttributes(token)
+	case 'n':
+		term.deviceStatusReport(token)
+	case 'L':
+		term.insertLines(token.Param(0, 1))
+	case 'M':
+		term.deleteLines(token.Param(0, 1))
+	case 'S':
+		term.ScrollUp(term.top, term.bot, token.Param(0, 1))
+	case 'T':
+		// with more parameters this is xterm's mouse highlight tracking
+		if len(token.Params) <= 1 {
+			term.ScrollDown(term.top, term.bot, token.Param(0, 1))
+		}
+	case 'A':
+		term.cursorUp(token.Param(0, 1))
+	case 'B', 'e':
+		term.cursorDown(token.Param(0, 1))
+	case 'C', 'a':
+		term.moveCursor(term.cursor.X+token.Param(0, 1), term.cursor.Y)
+	case 'D':
+		term.moveCursor(term.cursor.X-token.Param(0, 1), term.cursor.Y)
+	case 'E':
+		term.cursorDown(token.Param(0, 1))
+		term.moveCursor(0, term.cursor.Y)
+	case 'F':
+		term.cursorUp(token.Param(0, 1))
+		term.moveCursor(0, term.cursor.Y)
+	case 'G', '`':
+		term.moveCursor(token.Param(0, 1)-1, term.cursor.Y)
+	case 'H', 'f':
+		term.moveTo(token.Param(1, 1)-1, token.Param(0, 1)-1)
+	case 'd':
+		term.moveTo(term.cursor.X, token.Param(0, 1)-1)
+	case 'J':
+		term.eraseDisplay(token.Param(0, 0), false)
+	case 'K':
+		term.eraseLine(token.Param(0, 0), false)
+	case 'I':
+		term.tabForward(token.Param(0, 1))
+	case 'Z':
+		term.tabBackward(token.Param(0, 1))
+	case 'g':
+		// TBC
+		switch token.Param(0, 0) {
+		case 0:
+			term.tabStops[term.cursor.X] = false
+		case 3:
+			for i := range term.tabStops {
+				term.tabStops[i] = false
 			}
 		}
-	}()
-	return term, nil
+	case 'X':
+		// ECH
+		term.ClearRegion(term.cursor.X, term.cursor.Y, term.cursor.X+token.Param(0, 1)-1, term.cursor.Y, false)
+	case '@':
+		term.insertChars(token.Param(0, 1))
+	case 'r':
+		term.setScrollRegion(token.Param(0, 1)-1, token.Param(1, term.height)-1)
+	case 'm':
+		term.setGraphicsRendition(token)
+	case 's':
+		term.saveCursor()
+	case 'u':
+		term.restoreCursor()
+	case 'P':
+		term.deleteChars(token.Param(0, 1))
+	case 'h':
+		term.setModes(token, true)
+	case 'l':
+		term.setModes(token, false)
+	}
 }
 
-func (term *Terminal) ScrollUp() {
-	for i := term.bot; i > term.top; i-- {
-		term.glyphs[i] = term.glyphs[i-1]
+func (term *Terminal) handleOSC(token Token) {
+	parts := strings.SplitN(string(token.Literal), ";", 2)
+	if len(parts) < 2 {
+		return
 	}
-	term.glyphs[term.top] = make([]*Glyph, term.width)
-	for i := 0; i < term.height; i++ {
-		term.dirtyRows[i] = true
+	switch parts[0] {
+	case "0", "2":
+		term.ui.SetWindowTitle(parts[1])
 	}
-	redraw = true
 }
 
-func (term *Terminal) Scroll() {
-	for i := term.top; i < term.bot; i++ {
-		term.glyphs[i] = term.glyphs[i+1]
+func (term *Terminal) newGrid() [][]*Glyph {
+	grid := make([][]*Glyph, term.height+1)
+	for i := range grid {
+		grid[i] = make([]*Glyph, term.width+1)
+	}
+	return grid
+}
+
+func (term *Terminal) newRow() []*Glyph {
+	row := make([]*Glyph, term.width+1)
+	for i := 0; i < term.width; i++ {
+		row[i] = term.blank()
+	}
+	return row
+}
+
+// ScrollUp moves rows top..bot up by n, as SU and IND do at the bottom
+// margin, opening blank rows at the bottom. Rows leaving the top of
+// the screen go into the history.
+func (term *Terminal) ScrollUp(top, bot, n int) {
+	term.scrollUp(top, bot, n, top == 0)
+}
+
+func (term *Terminal) scrollUp(top, bot, n int, save bool) {
+	if n > bot-top+1 {
+		n = bot - top + 1
+	}
+	term.scrollSelection(top, bot, n)
+	if save {
+		term.saveLines(n)
+	}
+	for i := top; i <= bot-n; i++ {
+		term.glyphs[i] = term.glyphs[i+n]
+		term.wrapped[i] = term.wrapped[i+n]
+	}
+	for i := bot - n + 1; i <= bot; i++ {
+		term.glyphs[i] = term.newRow()
+		term.wrapped[i] = false
+	}
+	term.dirtyRange(top, bot)
+}
+
+// ScrollDown moves rows top..bot down by n, as SD and RI do at the top
+// margin, opening blank rows at the top.
+func (term *Terminal) ScrollDown(top, bot, n int) {
+	if n > bot-top+1 {
+		n = bot - top + 1
+	}
+	term.scrollSelection(top, bot, -n)
+	for i := bot; i >= top+n; i-- {
+		term.glyphs[i] = term.glyphs[i-n]
+		term.wrapped[i] = term.wrapped[i-n]
+	}
+	for i := top; i < top+n; i++ {
+		term.glyphs[i] = term.newRow()
+		term.wrapped[i] = false
 	}
-	term.glyphs[term.bot] = make([]*Glyph, term.width)
-	for i := 0; i < term.height; i++ {
+	term.dirtyRange(top, bot)
+}
+
+func (term *Terminal) dirtyRange(top, bot int) {
+	for i := top; i <= bot; i++ {
 		term.dirtyRows[i] = true
 	}
 	redraw = true
 }
 
-func (term *Terminal) IncreaseY() {
-	if term.top+term.cursor.Y+1 > term.bot {
-		term.Scroll()
-	} else {
+// Index moves the cursor down a row, scrolling the region if it is
+// on the bottom margin (IND).
+func (term *Terminal) Index() {
+	term.ui.EraseCursor(term)
+	term.wrapPending = false
+	if term.cursor.Y == term.bot {
+		term.ScrollUp(term.top, term.bot, 1)
+	} else if term.cursor.Y < term.height-1 {
 		term.cursor.Y += 1
 	}
 }
 
-func (term *Terminal) ClearRegion(x1, y1, x2, y2 int) {
-	y1 = y1 + term.top
-	y2 = y2 + term.top
+// ReverseIndex moves the cursor up a row, scrolling the region down
+// if it is on the top margin (RI).
+func (term *Terminal) ReverseIndex() {
+	term.ui.EraseCursor(term)
+	term.wrapPending = false
+	if term.cursor.Y == term.top {
+		term.ScrollDown(term.top, term.bot, 1)
+	} else if term.cursor.Y > 0 {
+		term.cursor.Y -= 1
+	}
+}
+
+// insertLines handles IL. Like DL it only acts when the cursor is
+// inside the scroll region, and leaves it in the first column.
+func (term *Terminal) insertLines(n int) {
+	if term.cursor.Y < term.top || term.cursor.Y > term.bot {
+		return
+	}
+	term.ScrollDown(term.cursor.Y, term.bot, n)
+	term.moveCursor(0, term.cursor.Y)
+}
 
+// deleteLines handles DL.
+func (term *Terminal) deleteLines(n int) {
+	if term.cursor.Y < term.top || term.cursor.Y > term.bot {
+		return
+	}
+	// deleted lines are gone, not scrolled off
+	term.scrollUp(term.cursor.Y, term.bot, n, false)
+	term.moveCursor(0, term.cursor.Y)
+}
+
+// insertChars handles ICH, opening n blank cells at the cursor and
+// pushing the rest of the row towards the right margin. Cells pushed
+// past it are lost.
+func (term *Terminal) insertChars(n int) {
+	x, y := term.cursor.X, term.cursor.Y
+	if n > term.width-x {
+		n = term.width - x
+	}
+	term.selectionChanged(y, y)
+	term.clearWide(x, y)
+	row := term.glyphs[y]
+	copy(row[x+n:term.width], row[x:term.width-n])
+	for i := x; i < x+n; i++ {
+		row[i] = term.blank()
+	}
+	term.fixWide(y)
+	term.wrapPending = false
+	term.dirtyRows[y] = true
+	redraw = true
+}
+
+// deleteChars handles DCH, pulling the rest of the row left over the
+// n cells at the cursor and filling in blanks at the right margin.
+func (term *Terminal) deleteChars(n int) {
+	x, y := term.cursor.X, term.cursor.Y
+	if n > term.width-x {
+		n = term.width - x
+	}
+	term.selectionChanged(y, y)
+	term.clearWide(x, y)
+	term.clearWide(x+n-1, y)
+	row := term.glyphs[y]
+	copy(row[x:term.width-n], row[x+n:term.width])
+	for i := term.width - n; i < term.width; i++ {
+		row[i] = term.blank()
+	}
+	term.fixWide(y)
+	term.wrapPending = false
+	term.dirtyRows[y] = true
+	redraw = true
+}
+
+// setScrollRegion handles DECSTBM, which also homes the cursor.
+func (term *Terminal) setScrollRegion(top, bot int) {
+	if bot > term.height-1 {
+		bot = term.height - 1
+	}
+	if top >= bot {
+		return
+	}
+	term.top = top
+	term.bot = bot
+	term.moveTo(0, 0)
+}
+
+// resetTabStops puts a tab stop every 8 columns. It has to be called
+// again whenever the width changes.
+func (term *Terminal) resetTabStops() {
+	term.tabStops = make([]bool, term.width)
+	for i := 8; i < term.width; i += 8 {
+		term.tabStops[i] = true
+	}
+}
+
+// tabForward moves the cursor to the n'th next tab stop, or the last
+// column if there are no more (HT, CHT). No cells are written.
+func (term *Terminal) tabForward(n int) {
+	x := term.cursor.X
+	for ; n > 0 && x < term.width-1; n-- {
+		for x++; x < term.width-1 && !term.tabStops[x]; x++ {
+		}
+	}
+	term.moveCursor(x, term.cursor.Y)
+}
+
+// tabBackward moves the cursor to the n'th previous tab stop, or the
+// first column (CBT).
+func (term *Terminal) tabBackward(n int) {
+	x := term.cursor.X
+	for ; n > 0 && x > 0; n-- {
+		for x--; x > 0 && !term.tabStops[x]; x-- {
+		}
+	}
+	term.moveCursor(x, term.cursor.Y)
+}
+
+// moveCursor puts the cursor at (x, y), clamped to the screen, or to
+// the scroll region in origin mode.
+func (term *Terminal) moveCursor(x, y int) {
+	top, bot := 0, term.height-1
+	if term.originMode {
+		top, bot = term.top, term.bot
+	}
+	if x < 0 {
+		x = 0
+	}
+	if x > term.width-1 {
+		x = term.width - 1
+	}
+	if y < top {
+		y = top
+	}
+	if y > bot {
+		y = bot
+	}
+
+	term.ui.EraseCursor(term)
+	term.cursor.X = x
+	term.cursor.Y = y
+	term.wrapPending = false
+}
+
+// moveTo positions the cursor absolutely (CUP, HVP, VPA). In origin
+// mode rows count from the top of the scroll region.
+func (term *Terminal) moveTo(x, y int) {
+	if term.originMode {
+		y += term.top
+	}
+	term.moveCursor(x, y)
+}
+
+// cursorUp moves up n rows, stopping at the top margin if the cursor
+// started inside the scroll region.
+func (term *Terminal) cursorUp(n int) {
+	y := term.cursor.Y - n
+	limit := 0
+	if term.cursor.Y >= term.top {
+		limit = term.top
+	}
+	if y < limit {
+		y = limit
+	}
+	term.ui.EraseCursor(term)
+	term.cursor.Y = y
+	term.wrapPending = false
+}
+
+// cursorDown moves down n rows, stopping at the bottom margin if the
+// cursor started inside the scroll region.
+func (term *Terminal) cursorDown(n int) {
+	y := term.cursor.Y + n
+	limit := term.height - 1
+	if term.cursor.Y <= term.bot {
+		limit = term.bot
+	}
+	if y > limit {
+		y = limit
+	}
+	term.ui.EraseCursor(term)
+	term.cursor.Y = y
+	term.wrapPending = false
+}
+
+// ClearRegion blanks the cells from (x1, y1) to (x2, y2) inclusive.
+// Erased cells keep the current background color, as xterm does with
+// bce. A selective erase (DECSED, DECSEL) leaves cells protected by
+// DECSCA alone.
+func (term *Terminal) ClearRegion(x1, y1, x2, y2 int, selective bool) {
 	if x1 > x2 {
 		x1, x2 = x2, x1
 	}
@@ -474,15 +869,68 @@ func (term *Terminal) ClearRegion(x1, y1, x2, y2 int) {
 	if x2 > term.width-1 {
 		x2 = term.width - 1
 	}
+	if y2 > term.height-1 {
+		y2 = term.height - 1
+	}
+	term.selectionChanged(y1, y2)
 
 	for i := y1; i <= y2; i++ {
 		for j := x1; j <= x2; j++ {
-			term.glyphs[i][j] = nil
+			if g := term.glyphs[i][j]; selective && g != nil && g.attr&ATTR_PROTECTED != 0 {
+				continue
+			}
+			term.glyphs[i][j] = term.blank()
+		}
+		term.fixWide(i)
+		if x2 == term.width-1 {
+			term.wrapped[i] = false
 		}
 	}
-	redraw = true
-	for i := y1; i < y2; i++ {
-		term.dirtyRows[i] = true
+	term.dirtyRange(y1, y2)
+}
+
+// blank returns an empty cell in the current background color, or nil
+// when that is the default.
+func (term *Terminal) blank() *Glyph {
+	if term.style.bg == COLOR_DEFAULT {
+		return nil
+	}
+	return &Glyph{char: ' ', Style: Style{bg: term.style.bg}}
+}
+
+// eraseDisplay handles ED and DECSED.
+func (term *Terminal) eraseDisplay(mode int, selective bool) {
+	x, y := term.cursor.X, term.cursor.Y
+	last := term.height - 1
+	switch mode {
+	case 0:
+		term.ClearRegion(x, y, term.width-1, y, selective)
+		if y < last {
+			term.ClearRegion(0, y+1, term.width-1, last, selective)
+		}
+	case 1:
+		if y > 0 {
+			term.ClearRegion(0, 0, term.width-1, y-1, selective)
+		}
+		term.ClearRegion(0, y, x, y, selective)
+	case 2:
+		term.ClearRegion(0, 0, term.width-1, last, selective)
+	case 3:
+		// xterm clears the scrollback and leaves the screen alone
+		term.clearHistory()
+	}
+}
+
+// eraseLine handles EL and DECSEL.
+func (term *Terminal) eraseLine(mode int, selective bool) {
+	x, y := term.cursor.X, term.cursor.Y
+	switch mode {
+	case 0:
+		term.ClearRegion(x, y, term.width-1, y, selective)
+	case 1:
+		term.ClearRegion(0, y, x, y, selective)
+	case 2:
+		term.ClearRegion(0, y, term.width-1, y, selective)
 	}
 }
 
@@ -495,17 +943,182 @@ func (term *Terminal) Draw() {
 		}
 
 		for i := range term.dirtyRows {
-			term.ui.DrawRect(term, true, bg, 0, i*term.cursor.height, term.width*term.cursor.width, i*term.cursor.height+term.cursor.height)
+			term.ui.DrawRect(term, true, term.palette.background, 0, i*term.cursor.height, term.width*term.cursor.width, i*term.cursor.height+term.cursor.height)
+			row := term.viewRow(i)
 			for j := 0; j < term.width; j++ {
-				g := term.glyphs[i][j]
-				if g != nil {
-					term.ui.WriteText(term, j, i, g.fg, g.bg, string(g.literal))
-				} else {
-					term.ui.DrawRect(term, false, bg, j*term.cursor.width, i*term.cursor.height, j*term.cursor.width+term.cursor.width, i*term.cursor.height+term.cursor.height)
+				g := row[j]
+				if g != nil && g.spacer {
+					// painted along with the wide glyph to its left
+					continue
 				}
+				term.drawCell(j, i)
 			}
 		}
 		term.dirtyRows = make(map[int]bool)
 		redraw = false
+		term.drawPreedit()
+	}
+}
+
+// glyphColors works out the colors a glyph is drawn with once
+// reverse video, dim, invisible and blink have been applied.
+func (term *Terminal) glyphColors(g *Glyph) (fg, bg xgraphics.BGRA) {
+	fg = term.palette.resolve(g.fg, term.palette.foreground)
+	bg = term.palette.resolve(g.bg, term.palette.background)
+	if g.attr&ATTR_REVERSE != 0 {
+		fg, bg = bg, fg
+	}
+	if g.attr&ATTR_DIM != 0 {
+		fg = blend(fg, bg, 2, 3)
+	}
+	if g.attr&ATTR_INVISIBLE != 0 || (g.attr&(ATTR_BLINK|ATTR_RAPID_BLINK) != 0 && !term.blinkOn) {
+		fg = bg
+	}
+	return fg, bg
+}
+
+// cellBackground returns the color behind the cell at (x, y).
+func (term *Terminal) cellBackground(x, y int) xgraphics.BGRA {
+	if term.isSelected(x, y) {
+		return term.palette.selectionBackground
+	}
+	if y >= term.height || x >= term.width || term.viewRow(y)[x] == nil {
+		return term.palette.background
+	}
+	_, bg := term.glyphColors(term.viewRow(y)[x])
+	return bg
+}
+
+// drawCell paints the cell at (x, y), including any decorations.
+func (term *Terminal) drawCell(x, y int) {
+	row := term.viewRow(y)
+	g := row[x]
+	if g != nil && g.spacer && x > 0 {
+		x--
+		g = row[x]
+	}
+
+	cw, ch := term.cursor.width, term.cursor.height
+	if g == nil {
+		term.ui.DrawRect(term, false, term.cellBackground(x, y), x*cw, y*ch, x*cw+cw, y*ch+ch)
+		return
+	}
+
+	fg, bg := term.glyphColors(g)
+	if term.isSelected(x, y) {
+		fg, bg = term.palette.selectionForeground, term.palette.selectionBackground
+	}
+	term.ui.SetFont(g.fontName())
+	term.ui.WriteText(term, x, y, fg, bg, g.String())
+	if fg == bg {
+		return
+	}
+
+	x0, y0 := x*cw, y*ch
+	x1 := x0 + cw
+	if g.wide {
+		x1 += cw
+	}
+	line := func(y int) {
+		term.ui.DrawRect(term, false, fg, x0, y, x1, y+1)
+	}
+
+	if g.underline != UNDERLINE_NONE {
+		ul := term.palette.resolve(g.ulColor, fg)
+		base := y0 + ch - 2
+		switch g.underline {
+		case UNDERLINE_SINGLE:
+			term.ui.DrawRect(term, false, ul, x0, base, x1, base+1)
+		case UNDERLINE_DOUBLE:
+			term.ui.DrawRect(term, false, ul, x0, base, x1, base+1)
+			term.ui.DrawRect(term, false, ul, x0, base-2, x1, base-1)
+		case UNDERLINE_CURLY:
+			for px := x0; px < x1; px += 2 {
+				off := 0
+				if (px/2)%2 == 1 {
+					off = -1
+				}
+				term.ui.DrawRect(term, false, ul, px, base+off, px+2, base+off+1)
+			}
+		case UNDERLINE_DOTTED:
+			for px := x0; px < x1; px += 2 {
+				term.ui.DrawRect(term, false, ul, px, base, px+1, base+1)
+			}
+		case UNDERLINE_DASHED:
+			for px := x0; px < x1; px += 4 {
+				term.ui.DrawRect(term, false, ul, px, base, px+3, base+1)
+			}
+		}
+	}
+	if g.attr&ATTR_STRIKE != 0 {
+		line(y0 + ch/2)
+	}
+	if g.attr&ATTR_OVERLINE != 0 {
+		line(y0)
+	}
+}
+
+// SetPreedit replaces the text being composed by the input method.
+// The caret is an index into text; the server's word for it isn't
+// trusted.
+func (term *Terminal) SetPreedit(text []rune, caret int) {
+	term.mu.Lock()
+	defer term.mu.Unlock()
+
+	term.preedit = text
+	term.preeditCaret = clamp(caret, 0, len(text))
+	if term.cursor.Y < term.height {
+		term.dirtyRows[term.cursor.Y] = true
+	}
+	redraw = true
+	needsDraw = true
+}
+
+// drawPreedit draws the text being composed, underlined, over the
+// cells from the cursor on. It is cut off at the right edge.
+func (term *Terminal) drawPreedit() {
+	if len(term.preedit) == 0 || term.cursor.Y >= term.height || term.scrollOffset > 0 {
+		return
+	}
+	cw, ch := term.cursor.width, term.cursor.height
+	fg, bg := term.palette.foreground, term.palette.background
+	term.ui.SetFont("regular")
+
+	x, y := term.cursor.X, term.cursor.Y
+	for i := 0; i < len(term.preedit); {
+		// keep combining marks with their base
+		j := i + 1
+		for j < len(term.preedit) && runeWidth(term.preedit[j]) == 0 {
+			j++
+		}
+		text := string(term.preedit[i:j])
+		w := stringWidth(text)
+		if x+w > term.width {
+			break
+		}
+		term.ui.WriteText(term, x, y, fg, bg, text)
+		term.ui.DrawRect(term, false, fg, x*cw, y*ch+ch-2, (x+w)*cw, y*ch+ch-1)
+		x += w
+		i = j
+	}
+}
+
+// blink toggles blinking text and marks the rows holding it dirty.
+func (term *Terminal) blink() {
+	if time.Since(term.lastBlink) < blinkInterval {
+		return
+	}
+	term.lastBlink = time.Now()
+	term.blinkOn = !term.blinkOn
+
+	for y := 0; y < term.height; y++ {
+		row := term.viewRow(y)
+		for x := 0; x < term.width; x++ {
+			if g := row[x]; g != nil && g.attr&(ATTR_BLINK|ATTR_RAPID_BLINK) != 0 {
+				term.dirtyRows[y] = true
+				redraw = true
+				break
+			}
+		}
 	}
 }
@@ -4,7 +4,6 @@ import (
 	"image"
 	"log"
 	"os"
-	"strings"
 
 	"github.com/sheik/freetype-go/freetype/truetype"
 	"github.com/sheik/xgb/xproto"
@@ -16,82 +15,287 @@ import (
 	"github.com/sheik/xgbutil/xwindow"
 )
 
+// clicks closer together than this, in milliseconds, count as a
+// double or triple click
+const doubleClickTime = 400
+
+// rows scrolled through the history per click of the wheel
+const wheelLines = 3
+
 type XGBGui struct {
-	X           *xgbutil.XUtil
-	font        *truetype.Font
-	fontRegular *truetype.Font
-	fontBold    *truetype.Font
-	img         *xgraphics.Image
-	window      *xwindow.Window
+	X              *xgbutil.XUtil
+	font           *truetype.Font
+	fontRegular    *truetype.Font
+	fontBold       *truetype.Font
+	fontItalic     *truetype.Font
+	fontBoldItalic *truetype.Font
+	img            *xgraphics.Image
+	window         *xwindow.Window
+	xim            *XIM
+	clipboard      *Clipboard
+
+	// the click that started the selection being dragged out, and
+	// how many clicks in a row it was
+	selecting      bool
+	lastClick      xproto.Timestamp
+	clickX, clickY int
+	clicks         int
+
+	// modifier masks, found from the keys bound to them
+	altMask        uint16
+	numLockMask    uint16
+	modeSwitchMask uint16
+	level3Mask     uint16
+	shiftLock      bool
 }
 
 func (x *XGBGui) KeyPressCallback(term *Terminal) func(*xgbutil.XUtil, xevent.KeyPressEvent) {
 	return func(X *xgbutil.XUtil, e xevent.KeyPressEvent) {
-		modStr := keybind.ModifierString(e.State)
-		keyStr := keybind.LookupString(X, e.State, e.Detail)
-
-		if keybind.KeyMatch(X, "Backspace", e.State, e.Detail) {
-			term.pty.Write([]byte{0x08})
+		// the input method gets first go, and sends back what it
+		// doesn't use
+		if x.xim.ForwardKey(e.Bytes()) {
 			return
 		}
+		x.handleKey(term, e)
+	}
+}
 
-		if keybind.KeyMatch(X, "Escape", e.State, e.Detail) {
-			if e.State&xproto.ModMaskControl > 0 {
-				log.Println("Control-Escape detected. Quitting...")
-				xevent.Quit(X)
-			}
-		}
+func (x *XGBGui) handleKey(term *Terminal, e xevent.KeyPressEvent) {
+	sym := x.keysym(e)
 
-		if keybind.KeyMatch(X, "Return", e.State, e.Detail) {
-			term.pty.Write([]byte{'\n'})
-			return
-		}
+	var mods KeyMods
+	if e.State&xproto.ModMaskShift != 0 {
+		mods |= MOD_SHIFT
+	}
+	if e.State&x.altMask != 0 {
+		mods |= MOD_ALT
+	}
+	if e.State&xproto.ModMaskControl != 0 {
+		mods |= MOD_CTRL
+	}
 
-		if keybind.KeyMatch(X, "Escape", e.State, e.Detail) {
-			term.pty.Write([]byte{27})
-			return
+	if sym == KEY_ESCAPE && mods == MOD_CTRL {
+		log.Println("Control-Escape detected. Quitting...")
+		xevent.Quit(x.X)
+		return
+	}
+	if (sym == 'C' || sym == 'c') && mods == MOD_CTRL|MOD_SHIFT {
+		x.copySelection(term, e.Time)
+		return
+	}
+	if (sym == 'V' || sym == 'v') && mods == MOD_CTRL|MOD_SHIFT {
+		x.clipboard.Request(x.clipboard.clipboard, e.Time)
+		return
+	}
+	if (sym == KEY_PRIOR || sym == KEY_NEXT) && mods == MOD_SHIFT {
+		page := term.height / 2
+		if sym == KEY_NEXT {
+			page = -page
 		}
+		term.mu.Lock()
+		term.ScrollView(page)
+		term.mu.Unlock()
+		return
+	}
+	x.sendKey(term, sym, mods)
+}
 
-		if keybind.KeyMatch(X, "Tab", e.State, e.Detail) {
-			term.pty.Write([]byte{'\t'})
-			return
+// sendKey writes what a key sends to the pty.
+func (x *XGBGui) sendKey(term *Terminal, sym uint32, mods KeyMods) {
+	term.mu.Lock()
+	b := encodeKey(sym, mods, term.keyModes())
+	if len(b) > 0 {
+		// modifiers on their own send nothing and leave the view be
+		term.snapToBottom()
+	}
+	term.mu.Unlock()
+
+	if len(b) > 0 {
+		term.pty.Write(b)
+	}
+}
+
+// sendText writes text typed through the input method.
+func (x *XGBGui) sendText(term *Terminal, text string) {
+	term.mu.Lock()
+	term.snapToBottom()
+	term.mu.Unlock()
+	term.pty.Write([]byte(text))
+}
+
+// mouseButtons maps X's button numbers onto the ones mouse reports use.
+var mouseButtons = map[xproto.Button]int{
+	1: MOUSE_LEFT, 2: MOUSE_MIDDLE, 3: MOUSE_RIGHT,
+	4: MOUSE_WHEEL_UP, 5: MOUSE_WHEEL_DOWN, 6: MOUSE_WHEEL_LEFT, 7: MOUSE_WHEEL_RIGHT,
+	8: MOUSE_BACK, 9: MOUSE_FORWARD,
+}
+
+// mouseEvent passes a button or pointer motion event on to the
+// terminal. For motion the button is worked out from the ones held
+// down. When the program isn't asking for the mouse, or Shift is held
+// down, it is used to select text instead.
+func (x *XGBGui) mouseEvent(term *Terminal, detail xproto.Button, state uint16, px, py int16, time xproto.Timestamp, release, motion bool) {
+	button, ok := mouseButtons[detail]
+	if motion {
+		button, ok = MOUSE_NO_BUTTON, true
+		switch {
+		case state&xproto.ButtonMask1 != 0:
+			button = MOUSE_LEFT
+		case state&xproto.ButtonMask2 != 0:
+			button = MOUSE_MIDDLE
+		case state&xproto.ButtonMask3 != 0:
+			button = MOUSE_RIGHT
 		}
+	}
+	if !ok {
+		return
+	}
 
-		if len(modStr) > 0 {
-			if strings.Contains(modStr, "shift") {
-				reply, _ := xproto.GetKeyboardMapping(x.X.Conn(), e.Detail, 1).Reply()
-				chr := string(reply.Keysyms[1])
-				term.pty.Write([]byte(chr))
-			}
-			if strings.Contains(modStr, "control") {
-				switch keyStr {
-				case "a":
-					term.pty.Write([]byte{0x01})
-				case "c":
-					term.pty.Write([]byte{0x03})
-				case "d":
-					term.pty.Write([]byte{0x04})
-				case "l":
-					term.pty.Write([]byte{0x0C})
-				case "p":
-					term.pty.Write([]byte{0x10})
-				case "r":
-					term.pty.Write([]byte{0x12})
-				}
+	var mods KeyMods
+	if state&x.altMask != 0 {
+		mods |= MOD_ALT
+	}
+	if state&xproto.ModMaskControl != 0 {
+		mods |= MOD_CTRL
+	}
+
+	term.mu.Lock()
+	ev := MouseEvent{
+		button:  button,
+		x:       clamp(int(px)/term.cursor.width, 0, term.width-1),
+		y:       clamp(int(py)/term.cursor.height, 0, term.height-1),
+		mods:    mods,
+		release: release,
+		motion:  motion,
+	}
+	var report []byte
+	reported := false
+	if state&xproto.ModMaskShift == 0 {
+		report, reported = term.ReportMouse(ev)
+	}
+	if !reported {
+		x.selectWithMouse(term, ev, time)
+	}
+	term.mu.Unlock()
+
+	if len(report) > 0 {
+		term.pty.Write(report)
+	}
+}
+
+// selectWithMouse drags out a selection with the left button. Two
+// clicks select words and three select lines, and holding Alt selects
+// a rectangle. The text becomes the PRIMARY selection when the button
+// is let go. The middle button pastes PRIMARY and the wheel scrolls
+// through the history.
+func (x *XGBGui) selectWithMouse(term *Terminal, ev MouseEvent, time xproto.Timestamp) {
+	if ev.button == MOUSE_WHEEL_UP || ev.button == MOUSE_WHEEL_DOWN {
+		if !ev.release {
+			lines := wheelLines
+			if ev.button == MOUSE_WHEEL_DOWN {
+				lines = -lines
 			}
+			term.ScrollView(lines)
+		}
+		return
+	}
+	if ev.button == MOUSE_MIDDLE && !ev.motion && !ev.release {
+		x.clipboard.Request(xproto.AtomPrimary, time)
+		return
+	}
+	if ev.button != MOUSE_LEFT {
+		return
+	}
+	switch {
+	case ev.motion:
+		if x.selecting {
+			term.ExtendSelection(ev.x, ev.y)
+		}
+	case !ev.release:
+		if time-x.lastClick < doubleClickTime && ev.x == x.clickX && ev.y == x.clickY {
+			x.clicks = x.clicks%3 + 1
 		} else {
-			switch keyStr {
-			case "Left":
-				term.pty.Write([]byte("\033[D"))
-			case "Up":
-				term.pty.Write([]byte("\033[A"))
-			case "Right":
-				term.pty.Write([]byte("\033[C"))
-			case "Down":
-				term.pty.Write([]byte("\033[B"))
-			}
-			if len(keyStr) == 1 {
-				term.pty.Write([]byte(keyStr))
+			x.clicks = 1
+		}
+		x.lastClick, x.clickX, x.clickY = time, ev.x, ev.y
+		x.selecting = true
+		term.StartSelection(ev.x, ev.y, SELECT_CHAR+x.clicks-1, ev.mods&MOD_ALT != 0)
+	case x.selecting:
+		x.selecting = false
+		s := term.selection
+		if s.mode == SELECT_CHAR && s.anchorX == s.pointX && s.anchorY == s.pointY {
+			// just a click
+			term.ClearSelection()
+			return
+		}
+		if text := term.SelectedText(); text != "" {
+			x.clipboard.Own(xproto.AtomPrimary, text, time)
+		}
+	}
+}
+
+// copySelection puts the selected text on the CLIPBOARD.
+func (x *XGBGui) copySelection(term *Terminal, time xproto.Timestamp) {
+	term.mu.Lock()
+	text := term.SelectedText()
+	term.mu.Unlock()
+	if text != "" {
+		x.clipboard.Own(x.clipboard.clipboard, text, time)
+	}
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// keysym picks the keysym for a key press from the keyboard mapping.
+func (x *XGBGui) keysym(e xevent.KeyPressEvent) uint32 {
+	n := int(keybind.KeyMapGet(x.X).KeysymsPerKeycode)
+	syms := make([]uint32, n)
+	for i := range syms {
+		syms[i] = uint32(keybind.KeysymGet(x.X, e.Detail, byte(i)))
+	}
+	return chooseKeysym(syms, KeyState{
+		shift:      e.State&xproto.ModMaskShift != 0,
+		lock:       e.State&xproto.ModMaskLock != 0,
+		shiftLock:  x.shiftLock,
+		numLock:    e.State&x.numLockMask != 0,
+		modeSwitch: e.State&x.modeSwitchMask != 0,
+		level3:     e.State&x.level3Mask != 0,
+	})
+}
+
+// loadModifiers works out which modifiers Alt, Num Lock, Mode_switch
+// and ISO_Level3_Shift are bound to, and whether Lock is Shift Lock
+// rather than Caps Lock.
+func (x *XGBGui) loadModifiers() {
+	x.altMask = xproto.ModMask1
+
+	modMap := keybind.ModMapGet(x.X)
+	n := byte(keybind.KeyMapGet(x.X).KeysymsPerKeycode)
+	for i, keycode := range modMap.Keycodes {
+		if keycode == 0 {
+			continue
+		}
+		mask := keybind.Modifiers[i/int(modMap.KeycodesPerModifier)]
+		for col := byte(0); col < n; col++ {
+			switch keybind.KeysymGet(x.X, keycode, col) {
+			case KEY_ALT_L, KEY_ALT_R:
+				x.altMask = mask
+			case KEY_NUM_LOCK:
+				x.numLockMask = mask
+			case KEY_MODE_SWITCH:
+				x.modeSwitchMask = mask
+			case KEY_ISO_LEVEL3_SHIFT:
+				x.level3Mask = mask
+			case KEY_SHIFT_LOCK:
+				x.shiftLock = mask == xproto.ModMaskLock
 			}
 		}
 	}
@@ -103,31 +307,26 @@ func (x *XGBGui) CreateWindow(term *Terminal) (err error) {
 		return err
 	}
 	keybind.Initialize(x.X)
+	x.loadModifiers()
 
-	fontReader, err := os.Open(fontPath)
+	x.fontRegular, err = loadFont(fontPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	x.font = x.fontRegular
 
-	// Now parse the font.
-	x.fontRegular, err = xgraphics.ParseFont(fontReader)
+	x.fontBold, err = loadFont(fontPathBold)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fontReader.Close()
 
-	fontReader, err = os.Open(fontPathBold)
-	if err != nil {
-		log.Fatal(err)
+	// italic faces are optional
+	if fontPathItalic != "" {
+		x.fontItalic, _ = loadFont(fontPathItalic)
 	}
-	x.font = x.fontRegular
-
-	// Now parse the font.
-	x.fontBold, err = xgraphics.ParseFont(fontReader)
-	if err != nil {
-		log.Fatal(err)
+	if fontPathBoldItalic != "" {
+		x.fontBoldItalic, _ = loadFont(fontPathBoldItalic)
 	}
-	fontReader.Close()
 
 	// set term width/height to full block
 	term.cursor.width, term.cursor.height = term.ui.GetCursorSize()
@@ -135,15 +334,54 @@ func (x *XGBGui) CreateWindow(term *Terminal) (err error) {
 	// Create some canvas.
 	x.img = xgraphics.New(x.X, image.Rect(0, 0, term.width*term.cursor.width, term.height*term.cursor.height))
 	x.img.For(func(x, y int) xgraphics.BGRA {
-		return bg
+		return term.palette.background
 	})
 
 	// Now show the image in its own window.
-	x.window = x.img.XShowExtra("goterm", true)
+	x.window = x.img.XShowExtra(windowTitle, true)
 
-	x.window.Listen(xproto.EventMaskKeyPress, xproto.EventMaskKeyRelease)
+	x.window.Listen(xproto.EventMaskKeyPress, xproto.EventMaskKeyRelease, xproto.EventMaskFocusChange,
+		xproto.EventMaskButtonPress, xproto.EventMaskButtonRelease, xproto.EventMaskPointerMotion,
+		xproto.EventMaskPropertyChange)
 
 	xevent.KeyPressFun(x.KeyPressCallback(term)).Connect(x.X, x.window.Id)
+	xevent.ButtonPressFun(func(X *xgbutil.XUtil, e xevent.ButtonPressEvent) {
+		x.mouseEvent(term, e.Detail, e.State, e.EventX, e.EventY, e.Time, false, false)
+	}).Connect(x.X, x.window.Id)
+	xevent.ButtonReleaseFun(func(X *xgbutil.XUtil, e xevent.ButtonReleaseEvent) {
+		x.mouseEvent(term, e.Detail, e.State, e.EventX, e.EventY, e.Time, true, false)
+	}).Connect(x.X, x.window.Id)
+	xevent.MotionNotifyFun(func(X *xgbutil.XUtil, e xevent.MotionNotifyEvent) {
+		x.mouseEvent(term, 0, e.State, e.EventX, e.EventY, e.Time, false, true)
+	}).Connect(x.X, x.window.Id)
+
+	x.clipboard, err = NewClipboard(x.X, x.window.Id)
+	if err != nil {
+		return err
+	}
+	x.clipboard.lost = func(selection xproto.Atom) {
+		if selection == xproto.AtomPrimary {
+			term.mu.Lock()
+			term.ClearSelection()
+			term.mu.Unlock()
+		}
+	}
+	x.clipboard.pasted = term.Paste
+
+	// input methods are optional
+	x.xim, err = NewXIM(x.X, x, term)
+	if err != nil && *debug {
+		log.Println("no input method:", err)
+	}
+	xevent.KeyReleaseFun(func(X *xgbutil.XUtil, e xevent.KeyReleaseEvent) {
+		x.xim.ForwardKey(e.Bytes())
+	}).Connect(x.X, x.window.Id)
+	xevent.FocusInFun(func(X *xgbutil.XUtil, e xevent.FocusInEvent) {
+		x.xim.SetFocus(true)
+	}).Connect(x.X, x.window.Id)
+	xevent.FocusOutFun(func(X *xgbutil.XUtil, e xevent.FocusOutEvent) {
+		x.xim.SetFocus(false)
+	}).Connect(x.X, x.window.Id)
 
 	return nil
 }
@@ -152,12 +390,32 @@ func (x *XGBGui) GetCursorSize() (width, height int) {
 	return xgraphics.Extents(x.font, size, "\u2588")
 }
 
+func loadFont(path string) (*truetype.Font, error) {
+	fontReader, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fontReader.Close()
+
+	return xgraphics.ParseFont(fontReader)
+}
+
 func (x *XGBGui) SetFont(weight string) {
 	switch weight {
 	case "regular":
 		x.font = x.fontRegular
 	case "bold":
 		x.font = x.fontBold
+	case "italic":
+		x.font = x.fontItalic
+		if x.font == nil {
+			x.font = x.fontRegular
+		}
+	case "bold-italic":
+		x.font = x.fontBoldItalic
+		if x.font == nil {
+			x.font = x.fontBold
+		}
 	}
 }
 
@@ -166,14 +424,18 @@ func (x *XGBGui) Clear(term *Terminal) {
 	box, ok := x.img.SubImage(rect).(*xgraphics.Image)
 	if ok {
 		box.For(func(x, y int) xgraphics.BGRA {
-			return bg
+			return term.palette.background
 		})
 		box.XDraw()
 	}
 }
 
 func (gui *XGBGui) WriteText(term *Terminal, x int, y int, fg, bg interface{}, text string) {
-	rect := image.Rect(x*term.cursor.width, y*term.cursor.height, x*term.cursor.width+term.cursor.width, y*term.cursor.height+term.cursor.height)
+	cells := stringWidth(text)
+	if cells < 1 {
+		cells = 1
+	}
+	rect := image.Rect(x*term.cursor.width, y*term.cursor.height, (x+cells)*term.cursor.width, y*term.cursor.height+term.cursor.height)
 	box, ok := gui.img.SubImage(rect).(*xgraphics.Image)
 	if ok {
 		box.For(func(x, y int) xgraphics.BGRA {
@@ -182,11 +444,54 @@ func (gui *XGBGui) WriteText(term *Terminal, x int, y int, fg, bg interface{}, t
 		box.XDraw()
 	}
 
-	_, _, err := gui.img.Text(x*term.cursor.width, y*term.cursor.height, fg.(xgraphics.BGRA), size, gui.font, text)
+	_, _, err := gui.img.Text(x*term.cursor.width, y*term.cursor.height, fg.(xgraphics.BGRA), size, gui.font, gui.renderable(text))
 
-	if err != nil {
-		log.Fatal(err)
+	// a glyph the rasterizer can't handle shouldn't take the terminal down
+	if err != nil && *debug {
+		log.Println("unable to draw", text, err)
+	}
+}
+
+// renderable replaces runes the current font has no glyph for with
+// U+FFFD, or '?' if the font doesn't have that either. Missing
+// combining marks are dropped.
+func (gui *XGBGui) renderable(text string) string {
+	missing := false
+	for _, r := range text {
+		if gui.font.Index(r) == 0 {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return text
+	}
+
+	replacement := '\uFFFD'
+	if gui.font.Index(replacement) == 0 {
+		replacement = '?'
+	}
+	var runes []rune
+	for _, r := range text {
+		if gui.font.Index(r) == 0 {
+			if runeWidth(r) == 0 {
+				// a missing mark is better left out
+				continue
+			}
+			r = replacement
+		}
+		runes = append(runes, r)
 	}
+	return string(runes)
+}
+
+// Close tears the window down once the terminal's input has gone
+// away, which also returns from the X event loop.
+func (x *XGBGui) Close(term *Terminal) {
+	xevent.Quit(x.X)
+	// the DestroyNotify wakes the event loop up so it sees the quit
+	x.window.Listen(xproto.EventMaskStructureNotify)
+	x.window.Destroy()
 }
 
 func (x *XGBGui) SetWindowTitle(title string) {
@@ -194,58 +499,54 @@ func (x *XGBGui) SetWindowTitle(title string) {
 }
 
 func (x *XGBGui) DrawCursor(term *Terminal) {
-	x.DrawRect(term,
-		false,
-		fg,
-		term.cursor.X*term.cursor.width,
-		term.cursor.Y*term.cursor.height,
-		(term.cursor.X*term.cursor.width)+term.cursor.width,
-		(term.cursor.Y*term.cursor.height)+term.cursor.height,
-	)
-
-	if term.cursor.Y > term.height-1 {
+	// the cursor is hidden while looking at the history
+	if term.cursor.Y > term.height-1 || term.scrollOffset > 0 {
 		return
 	}
+	cx := term.cursor.X
+	if cx > term.width-1 {
+		cx = term.width - 1
+	}
 
-	if term.cursor.X > term.width-1 {
+	if len(term.preedit) > 0 {
+		// a bar at the input method's caret
+		px := (cx + stringWidth(string(term.preedit[:term.preeditCaret]))) * term.cursor.width
+		if max := term.width*term.cursor.width - 2; px > max {
+			px = max
+		}
+		py := term.cursor.Y * term.cursor.height
+		x.DrawRect(term, false, term.palette.cursor, px, py, px+2, py+term.cursor.height)
 		return
 	}
 
-	g := term.glyphs[term.cursor.Y][term.cursor.X]
-	if g != nil {
-		x.WriteText(term, term.cursor.X*term.cursor.width, term.cursor.Y*term.cursor.height, g.fg, g.bg, string(g.literal))
+	g := term.glyphs[term.cursor.Y][cx]
+	if g == nil || g.spacer {
+		x.DrawRect(term,
+			false,
+			term.palette.cursor,
+			cx*term.cursor.width,
+			term.cursor.Y*term.cursor.height,
+			(cx*term.cursor.width)+term.cursor.width,
+			(term.cursor.Y*term.cursor.height)+term.cursor.height,
+		)
+		return
 	}
+
+	// draw the glyph under the cursor in reverse
+	_, bg := term.glyphColors(g)
+	x.SetFont(g.fontName())
+	x.WriteText(term, cx, term.cursor.Y, bg, term.palette.cursor, g.String())
 }
 
 func (x *XGBGui) EraseCursor(term *Terminal) {
-	rect := image.Rect(term.cursor.X*term.cursor.width, term.cursor.Y*term.cursor.height, (term.cursor.X*term.cursor.width)+term.cursor.width, (term.cursor.Y*term.cursor.height)+term.cursor.height)
-	box, ok := x.img.SubImage(rect).(*xgraphics.Image)
-
-	if ok {
-		box.For(func(x, y int) xgraphics.BGRA {
-			x = x / term.cursor.width
-			y = y / term.cursor.height
-			if term.glyphs[y][x] != nil {
-				return term.glyphs[y][x].bg
-			} else {
-				return bg
-			}
-		})
-		box.XDraw()
-	}
 	if term.cursor.Y > term.height-1 {
 		return
 	}
-	if term.cursor.X > term.width-1 {
-		return
-	}
-	g := term.glyphs[term.cursor.Y][term.cursor.X]
-	if g != nil {
-		_, _, err := x.img.Text(term.cursor.X*term.cursor.width, term.cursor.Y*term.cursor.height, g.fg, size, x.font, string(g.literal))
-		if err != nil {
-			panic(err)
-		}
+	cx := term.cursor.X
+	if cx > term.width-1 {
+		cx = term.width - 1
 	}
+	term.drawCell(cx, term.cursor.Y)
 	needsDraw = true
 }
 
@@ -257,11 +558,7 @@ func (gui *XGBGui) DrawRect(term *Terminal, redraw bool, color interface{}, x0,
 			if redraw {
 				x = x / term.cursor.width
 				y = y / term.cursor.height
-				if term.glyphs[y][x] != nil {
-					return term.glyphs[y][x].bg
-				} else {
-					return bg
-				}
+				return term.cellBackground(x, y)
 			} else {
 				return color.(xgraphics.BGRA)
 			}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sheik/xgb/xproto"
+	"github.com/sheik/xgbutil"
+	"github.com/sheik/xgbutil/xevent"
+	"github.com/sheik/xgbutil/xprop"
+	"github.com/sheik/xgbutil/xwindow"
+)
+
+// XIM protocol requests, from the X Input Method Protocol spec
+const (
+	XIM_CONNECT                    = 1
+	XIM_CONNECT_REPLY              = 2
+	XIM_ERROR                      = 20
+	XIM_OPEN                       = 30
+	XIM_OPEN_REPLY                 = 31
+	XIM_REGISTER_TRIGGERKEYS       = 34
+	XIM_SET_EVENT_MASK             = 37
+	XIM_ENCODING_NEGOTIATION       = 38
+	XIM_ENCODING_NEGOTIATION_REPLY = 39
+	XIM_CREATE_IC                  = 50
+	XIM_CREATE_IC_REPLY            = 51
+	XIM_SET_IC_FOCUS               = 58
+	XIM_UNSET_IC_FOCUS             = 59
+	XIM_FORWARD_EVENT              = 60
+	XIM_SYNC                       = 61
+	XIM_SYNC_REPLY                 = 62
+	XIM_COMMIT                     = 63
+	XIM_PREEDIT_START              = 73
+	XIM_PREEDIT_START_REPLY        = 74
+	XIM_PREEDIT_DRAW               = 75
+	XIM_PREEDIT_CARET              = 76
+	XIM_PREEDIT_CARET_REPLY        = 77
+	XIM_PREEDIT_DONE               = 78
+)
+
+// input styles
+const (
+	ximPreeditCallbacks = 0x0002
+	ximPreeditNothing   = 0x0008
+	ximStatusNothing    = 0x0400
+)
+
+// flags on XIM_FORWARD_EVENT and XIM_COMMIT
+const (
+	ximSynchronous  = 0x0001
+	ximLookupChars  = 0x0002
+	ximLookupKeySym = 0x0004
+)
+
+// preedit caret directions
+const (
+	ximForwardChar      = 0
+	ximBackwardChar     = 1
+	ximLineStart        = 4
+	ximLineEnd          = 5
+	ximAbsolutePosition = 10
+)
+
+// everything we send is little endian, which XIM_CONNECT announces
+var ximOrder = binary.LittleEndian
+
+// XIM is a client of an X input method server, such as ibus or fcitx,
+// found through XMODIFIERS. Key presses are forwarded to the server,
+// which sends back the ones it doesn't want along with any text it
+// has composed. Everything happens in X event callbacks, one reply at
+// a time.
+type XIM struct {
+	X    *xgbutil.XUtil
+	gui  *XGBGui
+	term *Terminal
+
+	// our end of the transport, and the server's
+	window   *xwindow.Window
+	imWindow xproto.Window
+
+	serverAtom   xproto.Atom
+	transport    xproto.Atom
+	xconnect     xproto.Atom
+	protocol     xproto.Atom
+	moreData     xproto.Atom
+	propertyAtom xproto.Atom
+
+	// transport version; 0.0 can only use client messages
+	major, minor uint32
+
+	// a message arriving in pieces
+	pending []byte
+
+	imid, icid uint16
+	icAttrs    map[string]uint16
+	utf8       bool
+	style      uint32
+
+	// events the server wants forwarded, and which of those it wants
+	// to answer before we carry on
+	forwardMask uint32
+	syncMask    uint32
+
+	focused bool
+}
+
+// NewXIM connects to the input method named by XMODIFIERS
+// (@im=name). It returns nil without an error when there isn't one.
+func NewXIM(X *xgbutil.XUtil, gui *XGBGui, term *Terminal) (*XIM, error) {
+	name := ""
+	for _, mod := range strings.Split(os.Getenv("XMODIFIERS"), "@") {
+		if strings.HasPrefix(mod, "im=") {
+			name = strings.TrimSpace(strings.TrimPrefix(mod, "im="))
+		}
+	}
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+
+	xim := &XIM{X: X, gui: gui, term: term, forwardMask: xproto.EventMaskKeyPress}
+	var err error
+	for _, a := range []struct {
+		atom *xproto.Atom
+		name string
+	}{
+		{&xim.serverAtom, "@server=" + name},
+		{&xim.transport, "TRANSPORT"},
+		{&xim.xconnect, "_XIM_XCONNECT"},
+		{&xim.protocol, "_XIM_PROTOCOL"},
+		{&xim.moreData, "_XIM_MOREDATA"},
+		{&xim.propertyAtom, "_GOTERM_XIM_DATA"},
+	} {
+		if *a.atom, err = xprop.Atm(X, a.name); err != nil {
+			return nil, err
+		}
+	}
+
+	owner, err := xproto.GetSelectionOwner(X.Conn(), xim.serverAtom).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if owner.Owner == 0 {
+		return nil, fmt.Errorf("no input method server for %q", name)
+	}
+
+	xim.window, err = xwindow.Generate(X)
+	if err != nil {
+		return nil, err
+	}
+	xim.window.Create(X.RootWin(), 0, 0, 1, 1, 0)
+	xevent.SelectionNotifyFun(xim.selectionNotify).Connect(X, xim.window.Id)
+	xevent.ClientMessageFun(xim.clientMessage).Connect(X, xim.window.Id)
+
+	// ask which transports the server speaks; the rest follows from
+	// the reply
+	xproto.ConvertSelection(X.Conn(), xim.window.Id, xim.serverAtom, xim.transport, xim.transport, 0)
+	return xim, nil
+}
+
+func (xim *XIM) selectionNotify(X *xgbutil.XUtil, e xevent.SelectionNotifyEvent) {
+	if e.Property != xim.transport {
+		return
+	}
+	reply, err := xproto.GetProperty(X.Conn(), true, xim.window.Id, xim.transport, xproto.GetPropertyTypeAny, 0, 1024).Reply()
+	if err != nil || !strings.Contains(string(reply.Value), "X/") {
+		xim.debug("input method doesn't speak the X transport")
+		return
+	}
+	owner, err := xproto.GetSelectionOwner(X.Conn(), xim.serverAtom).Reply()
+	if err != nil || owner.Owner == 0 {
+		return
+	}
+	// transport version 0.2: client messages, or properties for
+	// anything bigger
+	xim.sendClientMessage(owner.Owner, xim.xconnect, 32, []uint32{uint32(xim.window.Id), 0, 2})
+}
+
+func (xim *XIM) clientMessage(X *xgbutil.XUtil, e xevent.ClientMessageEvent) {
+	switch e.Type {
+	case xim.xconnect:
+		xim.imWindow = xproto.Window(e.Data.Data32[0])
+		xim.major, xim.minor = e.Data.Data32[1], e.Data.Data32[2]
+		// byte order, unused, protocol version 1.0, no auth
+		xim.send(XIM_CONNECT, 0, []byte{'l', 0, 1, 0, 0, 0, 0, 0})
+	case xim.moreData:
+		xim.pending = append(xim.pending, e.Data.Data8...)
+	case xim.protocol:
+		if e.Format == 32 {
+			length, atom := e.Data.Data32[0], xproto.Atom(e.Data.Data32[1])
+			reply, err := xproto.GetProperty(X.Conn(), true, xim.window.Id, atom, xproto.GetPropertyTypeAny, 0, (length+3)/4).Reply()
+			if err != nil {
+				xim.debug("unable to read message:", err)
+				return
+			}
+			xim.pending = append(xim.pending, reply.Value...)
+		} else {
+			xim.pending = append(xim.pending, e.Data.Data8...)
+		}
+		data := xim.pending
+		xim.pending = nil
+		xim.dispatch(data)
+	}
+}
+
+// dispatch handles each message in data. Messages sent as client
+// messages come padded out with zeros.
+func (xim *XIM) dispatch(data []byte) {
+	for len(data) >= 4 && data[0] != 0 {
+		n := 4 + 4*int(ximOrder.Uint16(data[2:]))
+		if n > len(data) {
+			xim.debug("short message", data[0])
+			return
+		}
+		xim.handle(data[0], data[4:n])
+		data = data[n:]
+	}
+}
+
+func (xim *XIM) handle(opcode byte, body []byte) {
+	r := &ximReader{buf: body}
+	switch opcode {
+	case XIM_CONNECT_REPLY:
+		xim.send(XIM_OPEN, 0, ximString(locale()))
+
+	case XIM_OPEN_REPLY:
+		xim.imid = r.u16()
+		// IM attributes, which we don't need
+		r.skip(int(r.u16()))
+		n := int(r.u16())
+		r.skip(2)
+		xim.icAttrs = map[string]uint16{}
+		attrs := &ximReader{buf: r.bytes(n)}
+		for attrs.more() {
+			id := attrs.u16()
+			attrs.skip(2)
+			name := attrs.bytes(int(attrs.u16()))
+			attrs.skip(pad(2 + len(name)))
+			xim.icAttrs[string(name)] = id
+		}
+		xim.negotiateEncoding()
+
+	case XIM_ENCODING_NEGOTIATION_REPLY:
+		r.skip(4)
+		// we offered UTF-8 first
+		xim.utf8 = int16(r.u16()) == 0
+		xim.createIC(ximPreeditCallbacks | ximStatusNothing)
+
+	case XIM_CREATE_IC_REPLY:
+		r.skip(2)
+		xim.icid = r.u16()
+		if xim.focused {
+			xim.setFocus(true)
+		}
+
+	case XIM_ERROR:
+		r.skip(4)
+		flag := r.u16()
+		code := r.u16()
+		if xim.icid == 0 && xim.style&ximPreeditCallbacks != 0 {
+			// the server can't draw preedit text through us, so
+			// leave it to draw the text itself
+			xim.createIC(ximPreeditNothing | ximStatusNothing)
+			return
+		}
+		xim.debug("input method error", code, flag)
+
+	case XIM_REGISTER_TRIGGERKEYS:
+		// only the static event flow is supported
+
+	case XIM_SET_EVENT_MASK:
+		r.skip(4)
+		xim.forwardMask = r.u32()
+		xim.syncMask = r.u32()
+
+	case XIM_FORWARD_EVENT:
+		r.skip(4)
+		flag := r.u16()
+		r.skip(2)
+		event := r.bytes(32)
+		if len(event) == 32 && event[0]&0x7f == xproto.KeyPress {
+			e := xproto.KeyPressEventNew(event).(xproto.KeyPressEvent)
+			xim.gui.handleKey(xim.term, xevent.KeyPressEvent{KeyPressEvent: &e})
+		}
+		if flag&ximSynchronous != 0 {
+			xim.syncReply()
+		}
+
+	case XIM_COMMIT:
+		r.skip(4)
+		flag := r.u16()
+		if flag&ximLookupKeySym != 0 {
+			r.skip(2)
+			sym := r.u32()
+			if flag&ximLookupChars == 0 {
+				xim.gui.sendKey(xim.term, sym, 0)
+			}
+		}
+		if flag&ximLookupChars != 0 {
+			text := r.bytes(int(r.u16()))
+			xim.term.SetPreedit(nil, 0)
+			xim.gui.sendText(xim.term, xim.decode(text))
+		}
+		if flag&ximSynchronous != 0 {
+			xim.syncReply()
+		}
+
+	case XIM_SYNC:
+		xim.syncReply()
+
+	case XIM_PREEDIT_START:
+		// no limit on the length of preedit text
+		xim.send(XIM_PREEDIT_START_REPLY, 0, xim.ids(0xff, 0xff, 0xff, 0xff))
+
+	case XIM_PREEDIT_DRAW:
+		r.skip(4)
+		caret := int(r.u32())
+		first := int(r.u32())
+		length := int(r.u32())
+		status := r.u32()
+		var text []rune
+		if status&1 == 0 {
+			text = []rune(xim.decode(r.bytes(int(r.u16()))))
+		}
+		xim.term.mu.Lock()
+		old := xim.term.preedit
+		xim.term.mu.Unlock()
+		if first > len(old) {
+			first = len(old)
+		}
+		if first+length > len(old) {
+			length = len(old) - first
+		}
+		preedit := append(append(append([]rune{}, old[:first]...), text...), old[first+length:]...)
+		xim.term.SetPreedit(preedit, caret)
+
+	case XIM_PREEDIT_CARET:
+		r.skip(4)
+		position := int(r.u32())
+		direction := r.u32()
+		xim.term.mu.Lock()
+		caret, n := xim.term.preeditCaret, len(xim.term.preedit)
+		preedit := xim.term.preedit
+		xim.term.mu.Unlock()
+		switch direction {
+		case ximForwardChar:
+			caret++
+		case ximBackwardChar:
+			caret--
+		case ximLineStart:
+			caret = 0
+		case ximLineEnd:
+			caret = n
+		case ximAbsolutePosition:
+			caret = position
+		}
+		if caret < 0 {
+			caret = 0
+		}
+		if caret > n {
+			caret = n
+		}
+		xim.term.SetPreedit(preedit, caret)
+		body := make([]byte, 4)
+		ximOrder.PutUint32(body, uint32(caret))
+		xim.send(XIM_PREEDIT_CARET_REPLY, 0, append(xim.ids(), body...))
+
+	case XIM_PREEDIT_DONE:
+		xim.term.SetPreedit(nil, 0)
+	}
+}
+
+// ForwardKey passes a key event to the input method. It returns false
+// if the input method isn't ready or doesn't want it, in which case
+// the caller should handle the key itself.
+func (xim *XIM) ForwardKey(event []byte) bool {
+	if xim == nil || xim.icid == 0 {
+		return false
+	}
+	mask := uint32(xproto.EventMaskKeyPress)
+	if event[0]&0x7f == xproto.KeyRelease {
+		mask = xproto.EventMaskKeyRelease
+	}
+	if xim.forwardMask&mask == 0 {
+		return false
+	}
+
+	var flag uint16
+	if xim.syncMask&mask != 0 {
+		flag = ximSynchronous
+	}
+	body := make([]byte, 4)
+	ximOrder.PutUint16(body, flag)
+	// the top half of the serial number, which we don't track
+	ximOrder.PutUint16(body[2:], 0)
+	xim.send(XIM_FORWARD_EVENT, 0, append(append(xim.ids(), body...), event...))
+	return true
+}
+
+// SetFocus tells the input method whether the window has the focus.
+func (xim *XIM) SetFocus(focused bool) {
+	if xim == nil {
+		return
+	}
+	xim.focused = focused
+	if xim.icid != 0 {
+		xim.setFocus(focused)
+	}
+}
+
+func (xim *XIM) setFocus(focused bool) {
+	if focused {
+		xim.send(XIM_SET_IC_FOCUS, 0, xim.ids())
+	} else {
+		xim.send(XIM_UNSET_IC_FOCUS, 0, xim.ids())
+	}
+}
+
+func (xim *XIM) syncReply() {
+	xim.send(XIM_SYNC_REPLY, 0, xim.ids())
+}
+
+func (xim *XIM) negotiateEncoding() {
+	var names []byte
+	for _, name := range []string{"UTF-8", "COMPOUND_TEXT"} {
+		names = append(names, byte(len(name)))
+		names = append(names, name...)
+	}
+	body := make([]byte, 4, 4+len(names)+8)
+	ximOrder.PutUint16(body, xim.imid)
+	ximOrder.PutUint16(body[2:], uint16(len(names)))
+	body = append(body, names...)
+	body = append(body, make([]byte, pad(len(names)))...)
+	// no encoding info
+	body = append(body, 0, 0, 0, 0)
+	xim.send(XIM_ENCODING_NEGOTIATION, 0, body)
+}
+
+// createIC asks for an input context for the window in the given
+// style.
+func (xim *XIM) createIC(style uint32) {
+	xim.style = style
+	win := uint32(xim.gui.window.Id)
+
+	var attrs []byte
+	for _, a := range []struct {
+		name  string
+		value uint32
+	}{
+		{"inputStyle", style},
+		{"clientWindow", win},
+		{"focusWindow", win},
+	} {
+		id, ok := xim.icAttrs[a.name]
+		if !ok {
+			continue
+		}
+		attr := make([]byte, 8)
+		ximOrder.PutUint16(attr, id)
+		ximOrder.PutUint16(attr[2:], 4)
+		ximOrder.PutUint32(attr[4:], a.value)
+		attrs = append(attrs, attr...)
+	}
+
+	body := make([]byte, 4)
+	ximOrder.PutUint16(body, xim.imid)
+	ximOrder.PutUint16(body[2:], uint16(len(attrs)))
+	xim.send(XIM_CREATE_IC, 0, append(body, attrs...))
+}
+
+// ids starts a message body with the input method and context ids.
+func (xim *XIM) ids(extra ...byte) []byte {
+	body := make([]byte, 4, 4+len(extra))
+	ximOrder.PutUint16(body, xim.imid)
+	ximOrder.PutUint16(body[2:], xim.icid)
+	return append(body, extra...)
+}
+
+// send writes a message to the server. Anything that doesn't fit in
+// a client message goes through a property on the server's window,
+// or in pieces if the server is too old for that.
+func (xim *XIM) send(major, minor byte, body []byte) {
+	body = append(body, make([]byte, pad(len(body)))...)
+	msg := make([]byte, 4, 4+len(body))
+	msg[0], msg[1] = major, minor
+	ximOrder.PutUint16(msg[2:], uint16(len(body)/4))
+	msg = append(msg, body...)
+
+	if len(msg) <= 20 {
+		xim.sendData(xim.protocol, msg)
+		return
+	}
+	if xim.major == 0 && xim.minor == 0 {
+		for len(msg) > 20 {
+			xim.sendData(xim.moreData, msg[:20])
+			msg = msg[20:]
+		}
+		xim.sendData(xim.protocol, msg)
+		return
+	}
+	xproto.ChangeProperty(xim.X.Conn(), xproto.PropModeAppend, xim.imWindow, xim.propertyAtom,
+		xproto.AtomString, 8, uint32(len(msg)), msg)
+	xim.sendClientMessage(xim.imWindow, xim.protocol, 32, []uint32{uint32(len(msg)), uint32(xim.propertyAtom)})
+}
+
+func (xim *XIM) sendData(typ xproto.Atom, data []byte) {
+	buf := make([]byte, 20)
+	copy(buf, data)
+	xim.sendClientMessage(xim.imWindow, typ, 8, buf)
+}
+
+func (xim *XIM) sendClientMessage(win xproto.Window, typ xproto.Atom, format byte, data interface{}) {
+	var union xproto.ClientMessageDataUnion
+	switch d := data.(type) {
+	case []byte:
+		union = xproto.ClientMessageDataUnionData8New(d)
+	case []uint32:
+		union = xproto.ClientMessageDataUnionData32New(append(d, make([]uint32, 5-len(d))...))
+	}
+	ev := xproto.ClientMessageEvent{Format: format, Window: win, Type: typ, Data: union}
+	xproto.SendEvent(xim.X.Conn(), false, win, xproto.EventMaskNoEvent, string(ev.Bytes()))
+}
+
+// decode turns text from the server into a string.
+func (xim *XIM) decode(text []byte) string {
+	if xim.utf8 && utf8.Valid(text) {
+		return string(text)
+	}
+	return decodeCompoundText(text)
+}
+
+func (xim *XIM) debug(args ...interface{}) {
+	if *debug {
+		fmt.Println(append([]interface{}{"xim:"}, args...)...)
+	}
+}
+
+// ximReader pulls fields out of a message body. Reading past the end
+// gives zeros.
+type ximReader struct {
+	buf []byte
+}
+
+func (r *ximReader) more() bool {
+	return len(r.buf) > 0
+}
+
+func (r *ximReader) bytes(n int) []byte {
+	if n > len(r.buf) {
+		n = len(r.buf)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *ximReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *ximReader) u16() uint16 {
+	b := r.bytes(2)
+	if len(b) < 2 {
+		return 0
+	}
+	return ximOrder.Uint16(b)
+}
+
+func (r *ximReader) u32() uint32 {
+	b := r.bytes(4)
+	if len(b) < 4 {
+		return 0
+	}
+	return ximOrder.Uint32(b)
+}
+
+// ximString encodes an XIM STR: a length byte then the text, padded
+// out to four bytes.
+func ximString(s string) []byte {
+	b := append([]byte{byte(len(s))}, s...)
+	return append(b, make([]byte, pad(len(b)))...)
+}
+
+// pad is how far n is from a multiple of four.
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
+
+// locale is the name XIM_OPEN asks for, from the usual variables.
+func locale() string {
+	for _, env := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+	}
+	return "C"
+}
+
+// decodeCompoundText handles the parts of COMPOUND_TEXT input methods
+// send in practice: ASCII and Latin-1, and UTF-8 in ESC % G segments.
+// Characters in other sets come out as U+FFFD.
+func decodeCompoundText(text []byte) string {
+	var b strings.Builder
+	gl, gr := true, true
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c != 0x1b {
+			switch {
+			case c < 0x20 || c == 0x7f:
+				b.WriteByte(c)
+			case c < 0x80 && gl, c >= 0xa0 && gr:
+				b.WriteRune(rune(c))
+			case c >= 0x20:
+				b.WriteRune(utf8.RuneError)
+			}
+			continue
+		}
+
+		seq := compoundEscape(text[i:])
+		if seq == nil {
+			break
+		}
+		i += len(seq) - 1
+		switch string(seq) {
+		case "\033(B":
+			gl = true
+		case "\033-A":
+			gr = true
+		case "\033%G":
+			// UTF-8 up to ESC % @
+			rest := text[i+1:]
+			end := strings.Index(string(rest), "\033%@")
+			if end < 0 {
+				end = len(rest)
+			}
+			b.Write(rest[:end])
+			i += end + 3
+		default:
+			if seq[1] == '(' || seq[1] == '$' && len(seq) > 3 && seq[2] == '(' {
+				gl = false
+			} else {
+				gr = false
+			}
+		}
+	}
+	return b.String()
+}
+
+// compoundEscape returns the escape sequence at the start of text:
+// ESC, any intermediates, then a final byte. It returns nil if the
+// sequence is malformed.
+func compoundEscape(text []byte) []byte {
+	for i := 1; i < len(text); i++ {
+		if text[i] >= 0x30 && text[i] <= 0x7e {
+			return text[:i+1]
+		}
+		if text[i] < 0x20 || text[i] > 0x2f {
+			break
+		}
+	}
+	return nil
+}